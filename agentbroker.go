@@ -0,0 +1,250 @@
+/*
+ * agentbroker.go
+ *
+ * ssh-agent deals with one request at a time per connection, and won't take
+ * more than 128 connections in its listen backlog, so with --agent we used to
+ * hold concurrency down to 128. The broker keeps a small pool of connections
+ * to the agent instead, and every sign request borrows one for as long as it
+ * takes the agent to answer. Handshakes at full --concurrency just queue up
+ * for a connection. Handshakes that want the agent's key list at the same
+ * time share one List call, and with --agentcache it's only fetched every so
+ * often rather than once per handshake.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AgentConnections is the default size of the agent connection pool.
+const AgentConnections = 4
+
+type agentConn struct {
+	conn   net.Conn
+	client agent.ExtendedAgent
+}
+
+// An agentBroker hands out agent signers that share a pool of connections.
+type agentBroker struct {
+	sock     string
+	pool     chan *agentConn
+	cacheFor time.Duration
+	mu       sync.Mutex
+	keys     []*agent.Key
+	listed   time.Time
+	listing  *agentListing // The List call under way, if there is one
+	e        Env
+}
+
+// An agentListing is a List call to the agent that everybody who wants the
+// keys while it's under way waits on, rather than each making their own.
+type agentListing struct {
+	done chan struct{}
+	keys []*agent.Key
+	err  error
+}
+
+// The newAgentBroker function dials conns connections to the agent at sock.
+func newAgentBroker(sock string, conns int, cacheFor time.Duration, e Env) (*agentBroker, error) {
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set.")
+	}
+	if conns < 1 {
+		conns = 1
+	}
+	ab := &agentBroker{
+		sock:     sock,
+		pool:     make(chan *agentConn, conns),
+		cacheFor: cacheFor,
+		e:        e,
+	}
+	for i := 0; i < conns; i++ {
+		ac, err := ab.dial()
+		if err != nil {
+			ab.close()
+			return nil, err
+		}
+		ab.pool <- ac
+	}
+	return ab, nil
+}
+
+func (ab *agentBroker) dial() (*agentConn, error) {
+	conn, err := net.Dial("unix", ab.sock)
+	if err != nil {
+		return nil, err
+	}
+	return &agentConn{conn, agent.NewClient(conn)}, nil
+}
+
+func (ab *agentBroker) close() {
+	for {
+		select {
+		case ac := <-ab.pool:
+			if err := ac.conn.Close(); err != nil {
+				ab.e.o.Debug("agent Close(): %s\n", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// The do method runs f with a connection from the pool. If the connection
+// died on us, say because the agent was restarted, we put a fresh one back
+// in its place and have another go.
+func (ab *agentBroker) do(f func(agent.ExtendedAgent) error) error {
+	ac := <-ab.pool
+	err := f(ac.client)
+	if err != nil && connBroken(err) {
+		ab.e.o.Debug("Agent connection broke: %s\n", err)
+		if cErr := ac.conn.Close(); cErr != nil {
+			ab.e.o.Debug("agent Close(): %s\n", cErr)
+		}
+		fresh, dErr := ab.dial()
+		if dErr != nil {
+			// Put the broken one back so the pool doesn't shrink, the
+			// next caller will try dialing again.
+			ab.pool <- ac
+			return err
+		}
+		ac = fresh
+		err = f(ac.client)
+	}
+	ab.pool <- ac
+	return err
+}
+
+func connBroken(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// The list method returns the agent's keys, from the cache if it's fresh.
+// The lock isn't held while we wait on the agent, so signing goes on while
+// we do.
+func (ab *agentBroker) list() ([]*agent.Key, error) {
+	ab.mu.Lock()
+	if ab.cacheFor > 0 && ab.keys != nil && time.Since(ab.listed) < ab.cacheFor {
+		keys := ab.keys
+		ab.mu.Unlock()
+		return keys, nil
+	}
+	if al := ab.listing; al != nil {
+		ab.mu.Unlock()
+		<-al.done
+		return al.keys, al.err
+	}
+	al := &agentListing{done: make(chan struct{})}
+	ab.listing = al
+	ab.mu.Unlock()
+
+	al.err = ab.do(func(client agent.ExtendedAgent) error {
+		var err error
+		al.keys, err = client.List()
+		return err
+	})
+	if al.err != nil {
+		al.keys = nil
+	}
+	ab.mu.Lock()
+	ab.listing = nil
+	if al.err == nil {
+		ab.keys = al.keys
+		ab.listed = time.Now()
+	}
+	ab.mu.Unlock()
+	close(al.done)
+	return al.keys, al.err
+}
+
+// The Signers method returns a signer for each key in the agent. They don't
+// hold on to a connection, they borrow one from the pool to sign.
+func (ab *agentBroker) Signers() ([]ssh.Signer, error) {
+	keys, err := ab.list()
+	if err != nil {
+		return nil, err
+	}
+	signers := make([]ssh.Signer, len(keys))
+	for i := range keys {
+		signers[i] = &brokerSigner{ab, keys[i]}
+	}
+	return signers, nil
+}
+
+// The Name method returns the comment of the agent key signer came from, or
+// its fingerprint if it doesn't have one.
+func (ab *agentBroker) Name(signer ssh.Signer) string {
+	key, ok := signer.PublicKey().(*agent.Key)
+	if !ok {
+		return ""
+	}
+	if key.Comment == "" {
+		return "agent:" + ssh.FingerprintSHA256(key)
+	}
+	return "agent:" + key.Comment
+}
+
+type brokerSigner struct {
+	ab  *agentBroker
+	pub ssh.PublicKey
+}
+
+func (bs *brokerSigner) PublicKey() ssh.PublicKey {
+	return bs.pub
+}
+
+func (bs *brokerSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return bs.SignWithAlgorithm(rand, data, "")
+}
+
+// The SignWithAlgorithm method lets RSA keys sign with SHA-2, which most
+// servers insist on these days.
+func (bs *brokerSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	var flags agent.SignatureFlags
+	switch algorithm {
+	case ssh.KeyAlgoRSASHA256, ssh.CertAlgoRSASHA256v01:
+		flags = agent.SignatureFlagRsaSha256
+	case ssh.KeyAlgoRSASHA512, ssh.CertAlgoRSASHA512v01:
+		flags = agent.SignatureFlagRsaSha512
+	}
+	var sig *ssh.Signature
+	err := bs.ab.do(func(client agent.ExtendedAgent) error {
+		var err error
+		sig, err = client.SignWithFlags(bs.pub, data, flags)
+		return err
+	})
+	return sig, err
+}
+
+// The getSSHConfigAgent function sets us up to authenticate with the keys in
+// the agent at SSH_AUTH_SOCK, through a broker.
+func getSSHConfigAgent(e Env) (*ssh.ClientConfig, identitySource, error) {
+	ab, err := newAgentBroker(
+		os.Getenv("SSH_AUTH_SOCK"),
+		e.c.AgentConns,
+		time.Duration(e.c.AgentCache)*time.Second,
+		e,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg := &ssh.ClientConfig{
+		User: e.c.User,
+		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(ab.Signers)},
+	}
+	return cfg, ab, nil
+}
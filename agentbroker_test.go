@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// A slowAgent takes its time listing keys, and counts how often it's asked.
+type slowAgent struct {
+	agent.Agent
+	lists   int32
+	release chan struct{}
+}
+
+func (sa *slowAgent) List() ([]*agent.Key, error) {
+	atomic.AddInt32(&sa.lists, 1)
+	<-sa.release
+	return sa.Agent.List()
+}
+
+func serveAgent(t *testing.T, a agent.Agent) string {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(a, conn)
+		}
+	}()
+	return sock
+}
+
+func TestAgentBrokerSharesList(t *testing.T) {
+	keyring := agent.NewKeyring()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	sa := &slowAgent{Agent: keyring, release: make(chan struct{})}
+	e, _ := testEnv()
+	ab, err := newAgentBroker(serveAgent(t, sa), AgentConnections, 0, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ab.close()
+
+	const handshakes = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, handshakes)
+	for i := 0; i < handshakes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			signers, err := ab.Signers()
+			if err == nil && len(signers) != 1 {
+				t.Errorf("got %d signers, want 1", len(signers))
+			}
+			errs <- err
+		}()
+	}
+	// Give them all time to pile up behind the first List.
+	time.Sleep(200 * time.Millisecond)
+	close(sa.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := atomic.LoadInt32(&sa.lists); n != 1 {
+		t.Errorf("the agent was asked for its keys %d times, want 1", n)
+	}
+	// With nothing under way, the next one asks again since there's no
+	// cache.
+	if _, err := ab.Signers(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&sa.lists); n != 2 {
+		t.Errorf("the agent was asked for its keys %d times, want 2", n)
+	}
+}
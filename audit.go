@@ -0,0 +1,151 @@
+/*
+ * audit.go
+ *
+ * Anybody who can SSH into MetaSSH can run things across the whole fleet, so
+ * with --auditlog we keep an append-only audit log of what gets done. Every
+ * CLI command, be it typed at the shell or sent over an exec channel, every
+ * run, and every session opened through a ControlMaster socket gets a JSON
+ * line saying who did it, from where, on which hosts, and how it went.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// The kinds of audit events.
+const (
+	auditCommand   = "command"
+	auditRunStart  = "run start"
+	auditRunDone   = "run done"
+	auditMux       = "mux session"
+	auditMuxDone   = "mux session done"
+	auditAgentSign = "agent sign"
+)
+
+// FingerprintExt is where the server auth callback leaves the fingerprint of
+// the client's key in its ssh.Permissions.
+const FingerprintExt = "metassh-fingerprint"
+
+// Audit is the audit log. Each entry goes out in a single write to a file
+// opened for appending, so lines from concurrent entries never interleave.
+type Audit struct {
+	mu sync.Mutex
+	fp *os.File
+}
+
+// An auditClient says who is doing something. For SSH clients that's the
+// fingerprint of the key they authenticated with, if they used one, and where
+// they came from. Via is how the command got to us: shell, exec or mux.
+type auditClient struct {
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Addr        string `json:"addr"`
+	User        string `json:"user,omitempty"`
+	Via         string `json:"via,omitempty"`
+}
+
+type auditEntry struct {
+	Time     time.Time    `json:"time"`
+	Event    string       `json:"event"`
+	Client   *auditClient `json:"client,omitempty"`
+	Command  string       `json:"command,omitempty"`
+	Remote   string       `json:"remote_command,omitempty"`
+	Key      string       `json:"key,omitempty"`
+	RunID    int          `json:"run_id,omitempty"`
+	Targets  []string     `json:"targets,omitempty"`
+	OK       *int         `json:"ok,omitempty"`
+	Failed   *int         `json:"failed,omitempty"`
+	ExitCode *int         `json:"exit_code,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Seconds  float64      `json:"seconds,omitempty"`
+}
+
+// OpenAudit opens the audit log at path for appending, creating it if need
+// be. Only we get to read it.
+func OpenAudit(path string) (*Audit, error) {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Audit{fp: fp}, nil
+}
+
+// The write method appends one entry to the audit log. It's fine to call it
+// on a nil *Audit, which is what we have when auditing is turned off.
+func (a *Audit) write(entry auditEntry) error {
+	if a == nil {
+		return nil
+	}
+	blob, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	blob = append(blob, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.fp.Write(blob)
+	return err
+}
+
+// The audit function fills in when and who for an entry and writes it to
+// the audit log. We don't stop anybody from working if the log can't be
+// written, but we do complain about it.
+func audit(e Env, entry auditEntry) {
+	if e.a == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	if entry.Client == nil {
+		entry.Client = e.who
+	}
+	if err := e.a.write(entry); err != nil {
+		e.o.Err("Can't write to the audit log: %s\n", err)
+	}
+}
+
+// The auditRun function logs how a finished run went, going by what the run
+// history has on it.
+func auditRun(e Env, id int, took time.Duration) {
+	entry := auditEntry{
+		Event:   auditRunDone,
+		RunID:   id,
+		Seconds: took.Seconds(),
+	}
+	ok, failed := 0, 0
+	rr, err := e.s.GetRun(id)
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Remote = rr.cmd
+		for _, res := range rr.results {
+			if res.ok {
+				ok++
+			} else {
+				failed++
+			}
+		}
+	}
+	entry.OK = intPtr(ok)
+	entry.Failed = intPtr(failed)
+	audit(e, entry)
+}
+
+// The withVia function returns a copy of e whose client is marked as having
+// come in via the given channel.
+func withVia(e Env, via string) Env {
+	if e.who != nil {
+		who := *e.who
+		who.Via = via
+		e.who = &who
+	}
+	return e
+}
+
+func intPtr(i int) *int {
+	return &i
+}
@@ -0,0 +1,401 @@
+/*
+ * balancer.go
+ *
+ * With -b N we keep N connections open to every bastion we connect to
+ * directly. Rather than having them all listen on one shared channel and
+ * spreading the load by chance, a balancer goroutine sits in front of them.
+ * It keeps track of how many proxied channels each connection is carrying,
+ * hands new work to the least loaded one (or round-robin), and opens extra
+ * connections on demand once every connection is past --bastionchans.
+ *
+ * A connection that doesn't take the work it's given within StuckBastionConn,
+ * say because it's waiting on a keep-alive that's never coming back, is taken
+ * out of rotation and the work goes to another one.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Ways to pick a bastion connection for new work.
+const (
+	BalanceLeastLoaded = "least"
+	BalanceRoundRobin  = "rr"
+	MaxBastionConns    = 64 // Never open more than this to one bastion
+	StuckBastionConn   = 10 * time.Second
+)
+
+var errNoBastionConns = kindError(kindProxy, stageProxy, errors.New("No connections to bastion left."))
+var errStuckBastionConn = kindError(kindProxy, stageProxy, errors.New("Connection to bastion is stuck."))
+
+type bastionStatsRequest struct {
+	response chan<- bastionStats
+}
+
+type bastionStats struct {
+	hostName string
+	policy   string
+	opening  bool
+	conns    []bastionConnStats
+}
+
+type bastionConnStats struct {
+	id       int
+	channels int
+	total    int
+	opened   time.Time
+}
+
+// bastionConn is one SSH connection to a bastion, and its accounting.
+type bastionConn struct {
+	bastionConnStats
+	reqChan chan interface{}
+}
+
+type channelClosed struct {
+	id int
+}
+
+type bastionConnAdded struct {
+	client *ssh.Client
+	err    error
+}
+
+type bastionConnLost struct {
+	id  int
+	err error
+}
+
+type balancer struct {
+	link    string
+	me      string
+	e       Env
+	conns   []*bastionConn
+	next    int
+	nextID  int
+	opening bool
+	dial    func() (*ssh.Client, error)
+	events  chan interface{}
+	done    chan bool
+}
+
+// The newBalancer function starts up a balancer for the given bastion
+// connections, and returns the channel to send it requests on. The dial
+// function is used to open more connections when the existing ones get busy.
+func newBalancer(link string, clients []*ssh.Client, dial func() (*ssh.Client, error), e Env) chan interface{} {
+	listen := make(chan interface{})
+	me := link
+	if host := e.s.GetPTR(link); host != "" {
+		me = host
+	}
+	b := &balancer{
+		link:   link,
+		me:     me,
+		e:      e,
+		dial:   dial,
+		events: make(chan interface{}),
+		done:   make(chan bool),
+	}
+	for i := range clients {
+		b.addConn(clients[i])
+	}
+	go b.run(listen)
+	return listen
+}
+
+func (b *balancer) addConn(client *ssh.Client) {
+	bc := &bastionConn{
+		bastionConnStats: bastionConnStats{id: b.nextID, opened: time.Now()},
+		reqChan:          make(chan interface{}),
+	}
+	b.nextID++
+	id := bc.id
+	lost := func(err error) {
+		b.notify(bastionConnLost{id, err})
+	}
+	go remoteHost(b.link, id, bc.reqChan, b.e, client, true, lost)
+	b.conns = append(b.conns, bc)
+}
+
+// Goroutines we fire off tell us things through the events channel, but
+// once we're gone there is nobody to listen, so don't hang around.
+func (b *balancer) notify(event interface{}) {
+	select {
+	case b.events <- event:
+	case <-b.done:
+	}
+}
+
+func (b *balancer) run(listen <-chan interface{}) {
+	defer close(b.done)
+	for {
+		select {
+		case req := <-listen:
+			switch req.(type) {
+			case proxyRequest:
+				pReq := req.(proxyRequest)
+				for {
+					bc := b.pick()
+					if bc == nil {
+						pReq.response <- proxyResponse{err: errNoBastionConns}
+						break
+					}
+					tReq, abandon := b.track(bc.id, pReq)
+					if b.handoff(bc, tReq) {
+						bc.channels++
+						bc.total++
+						b.grow()
+						break
+					}
+					abandon()
+				}
+			case runRequest, dialRequest:
+				for {
+					bc := b.pick()
+					if bc == nil {
+						b.e.o.Debug("%s: no connections left.\n", b.me)
+						b.fail(req)
+						break
+					}
+					if b.handoff(bc, req) {
+						break
+					}
+				}
+			case bastionStatsRequest:
+				bsReq := req.(bastionStatsRequest)
+				bsReq.response <- b.stats()
+			case cleanupRequest:
+				cReq := req.(cleanupRequest)
+				allGood := true
+				for i := range b.conns {
+					if !b.cleanup(b.conns[i]) {
+						allGood = false
+					}
+				}
+				b.conns = nil
+				cReq.response <- cleanupResponse{allGood}
+				return
+			default:
+				b.e.o.Debug("Unknown request type: %v\n", req)
+			}
+		case event := <-b.events:
+			switch event.(type) {
+			case channelClosed:
+				cc := event.(channelClosed)
+				for i := range b.conns {
+					if b.conns[i].id == cc.id && b.conns[i].channels > 0 {
+						b.conns[i].channels--
+					}
+				}
+			case bastionConnAdded:
+				bca := event.(bastionConnAdded)
+				b.opening = false
+				if bca.err != nil {
+					b.e.o.Debug("%s: extra connection failed: %s\n", b.me, bca.err)
+					continue
+				}
+				b.addConn(bca.client)
+				b.e.o.Debug("%s: now %d connections.\n", b.me, len(b.conns))
+			case bastionConnLost:
+				bcl := event.(bastionConnLost)
+				// One we already dropped for being stuck was accounted
+				// for back then, bastion and all.
+				if !b.drop(bcl.id) {
+					continue
+				}
+				if len(b.conns) == 0 {
+					// That was the last one, so the bastion is lost.
+					go hostLost(b.e, b.me, true, bcl.err)
+				}
+			}
+		}
+	}
+}
+
+// The track method hooks up a proxy request so that we find out when the
+// channel it opens goes away, or if it never opened at all. If the request
+// never gets handed off, call abandon.
+func (b *balancer) track(id int, pReq proxyRequest) (tracked proxyRequest, abandon func()) {
+	var once sync.Once
+	closed := func() {
+		once.Do(func() { b.notify(channelClosed{id}) })
+	}
+	respChan := make(chan proxyResponse)
+	abandoned := make(chan struct{})
+	orig := pReq.response
+	go func() {
+		select {
+		case resp := <-respChan:
+			if resp.err != nil {
+				closed()
+			}
+			orig <- resp
+		case <-abandoned:
+		}
+	}()
+	pReq.response = respChan
+	pReq.closed = closed
+	return pReq, func() { close(abandoned) }
+}
+
+// The handoff method gives req to bc. If bc doesn't take it in time, it's
+// stuck, so it's taken out of rotation and we return false.
+func (b *balancer) handoff(bc *bastionConn, req interface{}) bool {
+	timer := time.NewTimer(StuckBastionConn)
+	defer timer.Stop()
+	select {
+	case bc.reqChan <- req:
+		return true
+	case <-timer.C:
+	}
+	b.e.o.Debug("%s: connection #%d is stuck, dropping it.\n", b.me, bc.id)
+	for i := range b.conns {
+		if b.conns[i] == bc {
+			b.conns = append(b.conns[:i], b.conns[i+1:]...)
+			break
+		}
+	}
+	// It'll get to the cleanup when it gets unstuck, if it ever does, but
+	// we're not going to wait around for that.
+	go b.cleanup(bc)
+	if len(b.conns) == 0 {
+		go hostLost(b.e, b.me, true, errStuckBastionConn)
+	}
+	return false
+}
+
+func (b *balancer) pick() *bastionConn {
+	if len(b.conns) == 0 {
+		return nil
+	}
+	if b.e.c.BastionBalance == BalanceRoundRobin {
+		bc := b.conns[b.next%len(b.conns)]
+		b.next++
+		return bc
+	}
+	best := b.conns[0]
+	for i := range b.conns {
+		if b.conns[i].channels < best.channels {
+			best = b.conns[i]
+		}
+	}
+	return best
+}
+
+// Open another connection once every connection we have is carrying at
+// least --bastionchans channels.
+func (b *balancer) grow() {
+	threshold := b.e.c.BastionChans
+	if threshold <= 0 || b.opening || len(b.conns) >= MaxBastionConns {
+		return
+	}
+	for i := range b.conns {
+		if b.conns[i].channels < threshold {
+			return
+		}
+	}
+	b.opening = true
+	b.e.o.Debug("%s: all connections busy, opening another.\n", b.me)
+	go func() {
+		client, err := b.dial()
+		b.notify(bastionConnAdded{client, err})
+	}()
+}
+
+// The drop method cleans up the connection with the given id and takes it
+// out of rotation. It returns false if we didn't have it anymore.
+func (b *balancer) drop(id int) bool {
+	for i := range b.conns {
+		if b.conns[i].id == id {
+			b.cleanup(b.conns[i])
+			b.conns = append(b.conns[:i], b.conns[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *balancer) cleanup(bc *bastionConn) bool {
+	respChan := make(chan cleanupResponse)
+	bc.reqChan <- cleanupRequest{respChan}
+	resp := <-respChan
+	return resp.allGood
+}
+
+// Requests we can't hand to anybody still need an answer.
+func (b *balancer) fail(req interface{}) {
+	switch req.(type) {
+	case runRequest:
+		req.(runRequest).response <- runResponse{err: errNoBastionConns}
+	case dialRequest:
+		req.(dialRequest).response <- dialResponse{err: errNoBastionConns}
+	}
+}
+
+func (b *balancer) stats() bastionStats {
+	bs := bastionStats{
+		hostName: b.me,
+		policy:   b.e.c.BastionBalance,
+		opening:  b.opening,
+	}
+	for i := range b.conns {
+		bs.conns = append(bs.conns, b.conns[i].bastionConnStats)
+	}
+	return bs
+}
+
+// notifyConn is a net.Conn that lets us know when it gets closed.
+type notifyConn struct {
+	net.Conn
+	closed func()
+}
+
+func (c *notifyConn) Close() error {
+	c.closed()
+	return c.Conn.Close()
+}
+
+// The outputBastions function shows per-connection stats for every bastion
+// that we connect to directly.
+func outputBastions(e Env) {
+	ck := e.s.GetConnKeys()
+	for i := range ck {
+		ci, err := e.s.GetConnInfo(ck[i])
+		if err != nil || !ci.isProxy || !ci.isDirect {
+			continue
+		}
+		respChan := make(chan bastionStats)
+		ci.reqChan <- bastionStatsRequest{respChan}
+		bs := <-respChan
+		opening := ""
+		if bs.opening {
+			opening = ", opening another"
+		}
+		e.o.Out(
+			"bastion %s via %s: %d connections (%s%s)\n",
+			bs.hostName,
+			ci.via,
+			len(bs.conns),
+			bs.policy,
+			opening,
+		)
+		for j := range bs.conns {
+			bc := bs.conns[j]
+			e.o.Out(
+				"\t#%d: %d channels, %d total, up %.0fs\n",
+				bc.id,
+				bc.channels,
+				bc.total,
+				time.Since(bc.opened).Seconds(),
+			)
+		}
+	}
+}
@@ -10,21 +10,19 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
-	"os/exec"
+	"io/ioutil"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
-	"github.com/bmizerany/perks/quantile"
 	"github.com/ogier/pflag"
 
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/terminal"
 	"golang.org/x/sys/unix"
 )
@@ -56,31 +54,42 @@ var commands map[string]command
 // Avoid an initialization loop using init()
 func init() {
 	commands = map[string]command{
-		"state":    {state, "Get the state of in-flight connections/runs."},
-		"run":      {run, "Run a command on loaded/connected targets."},
-		"target":   {target, "Target some hosts to connect/run commands on."},
-		"clear":    {clear, "Clear the list of targets, implies disco."},
-		"clean":    {clean, "Removed timed out host from the target list."},
-		"exit":     {quit, "I'm outta here."},
-		"quit":     {quit, "Cya."},
-		"abort":    {abort, "Abort any in-flight connections/runs."},
-		"disco":    {disco, "Disconnect all targeted hosts."},
-		"connect":  {connect, "Connect all targeted hosts."},
-		"summary":  {summary, "Show some stats about connections/runs."},
-		"spool":    {spool, "Toggle spool state."},
-		"spooldir": {spooldir, "Set or print the spool directory."},
-		"help":     {help, "This help screen."},
-		"quant":    {quant, "Show some quantiles."},
-		"tee":      {tee, "Tee the output to stdout/stderr if spooling."},
+		"state":      {state, "Get the state of in-flight connections/runs."},
+		"run":        {run, "Run a command on loaded/connected targets."},
+		"target":     {target, "Target some hosts to connect/run commands on."},
+		"clear":      {clear, "Clear the list of targets, implies disco."},
+		"clean":      {clean, "Removed timed out host from the target list."},
+		"exit":       {quit, "I'm outta here."},
+		"quit":       {quit, "Cya."},
+		"abort":      {abort, "Abort any in-flight connections/runs."},
+		"disco":      {disco, "Disconnect all targeted hosts."},
+		"connect":    {connect, "Connect all targeted hosts."},
+		"summary":    {summary, "Show some stats about connections/runs."},
+		"spool":      {spool, "Toggle spool state."},
+		"spooldir":   {spooldir, "Set or print the spool directory."},
+		"help":       {help, "This help screen."},
+		"quant":      {quant, "Show some quantiles."},
+		"save":       {save, "Save a snapshot of the targets and results."},
+		"history":    {history, "List the recent runs."},
+		"show-run":   {showRun, "Show the summary of a run from the history."},
+		"diff-run":   {diffRun, "Show hosts whose results changed between two runs."},
+		"tee":        {tee, "Tee the output to stdout/stderr if spooling."},
+		"group":      {groupCmd, "Save, use and combine named groups of targets."},
+		"select":     {selectCmd, "Pick the targets runs go to with an expression."},
+		"exclude":    {exclude, "Drop targets matching an expression from the pick."},
+		"agent-add":  {agentAdd, "Add a key to the agent we forward to hosts."},
+		"agent-list": {agentList, "List the keys in the agent we forward to hosts."},
+		"agent-rm":   {agentRm, "Remove a key from the agent we forward to hosts."},
 	}
 }
 
 func quant(e Env, args []string) error {
 	type config struct {
-		Run     bool `short:"r" desc:"Show the specified run quantile"`
-		Connect bool `short:"c" desc:"Show the specified connect quantile."`
+		Run       bool `short:"r" desc:"Show the specified run quantile"`
+		Connect   bool `short:"c" desc:"Show the specified connect quantile."`
+		Histogram bool `short:"H" desc:"Show a histogram instead of a quantile, of both unless -r or -c."`
 	}
-	cfg := &config{false, false}
+	cfg := &config{false, false, false}
 	f, err := reflectFlags("quant", cfg, e.o)
 	if err != nil {
 		return err
@@ -88,6 +97,9 @@ func quant(e Env, args []string) error {
 	if err = f.Parse(args); err != nil {
 		return err
 	}
+	if cfg.Histogram && !cfg.Run && !cfg.Connect {
+		cfg.Run, cfg.Connect = true, true
+	}
 	if !cfg.Run && !cfg.Connect {
 		return errors.New("Need to specify either -r or -c.")
 	}
@@ -109,7 +121,7 @@ func quant(e Env, args []string) error {
 			end = .95
 		case .01:
 			start = 0.0
-			end = 0.1
+			end = 0.01
 		default:
 			return errors.New("Must specfy a range like, 0.95 0.99.")
 		}
@@ -128,13 +140,13 @@ func quant(e Env, args []string) error {
 		if start >= 1 || end > 1 {
 			return errors.New("Both start and end values must be <= 1.0")
 		}
-	} else {
+	} else if !cfg.Histogram {
 		return errors.New("Must specfy a range like, 0.95 0.99.")
 	}
 
 	var hk = e.s.GetHostKeys()
-	qConnect := quantile.NewBiased()
-	qRun := quantile.NewBiased()
+	conTimes := make(map[string]float64)
+	runTimes := make(map[string]float64)
 
 	for i := range hk {
 		hostname := hk[i]
@@ -144,30 +156,37 @@ func quant(e Env, args []string) error {
 			continue
 		}
 		if hi.runOK && hi.runOnce {
-			qRun.Insert(hi.runTime.Seconds())
+			runTimes[hostname] = hi.runTime.Seconds()
 		}
 		if hi.connectedOK {
-			qConnect.Insert(hi.connectTime.Seconds())
+			conTimes[hostname] = hi.connectTime.Seconds()
+		}
+	}
+	qConnect := newSamples(mapValues(conTimes))
+	qRun := newSamples(mapValues(runTimes))
+
+	if cfg.Histogram {
+		if cfg.Connect {
+			outputHistogram(e, "Connect", qConnect)
 		}
+		if cfg.Run {
+			outputHistogram(e, "Run", qRun)
+		}
+		return nil
 	}
 
 	conResults := make(map[string]float64)
 	runResults := make(map[string]float64)
 
-	for i := range hk {
-		hostname := hk[i]
-		hi, err := e.s.GetHostInfo(hostname)
-		if err != nil {
-			e.o.Debug("GetHostInfo(): %s\n", err)
-			continue
-		}
-		runTime := hi.runTime.Seconds()
-		conTime := hi.connectTime.Seconds()
-
-		if conTime >= qConnect.Query(start) && conTime <= qConnect.Query(end) {
+	conStart, conEnd := qConnect.percentile(start), qConnect.percentile(end)
+	for hostname, conTime := range conTimes {
+		if conTime >= conStart && conTime <= conEnd {
 			conResults[hostname] = conTime
 		}
-		if runTime >= qRun.Query(start) && runTime <= qRun.Query(end) {
+	}
+	runStart, runEnd := qRun.percentile(start), qRun.percentile(end)
+	for hostname, runTime := range runTimes {
+		if runTime >= runStart && runTime <= runEnd {
 			runResults[hostname] = runTime
 		}
 	}
@@ -290,11 +309,13 @@ func help(e Env, args []string) error {
 func run(e Env, args []string) error {
 	newEnv := e
 	type config struct {
-		Background bool `short:"b" desc:"Run in the background, don't wait."`
-		Timeout    int  `short:"t" desc:"Run timeout in seconds."`
-		Quiet      bool `short:"q" desc:"No output please."`
+		Background bool   `short:"b" desc:"Run in the background, don't wait."`
+		Timeout    int    `short:"t" desc:"Run timeout in seconds."`
+		Quiet      bool   `short:"q" desc:"No output please."`
+		Group      string `short:"g" desc:"Run on this group rather than the selection."`
+		Template   bool   `short:"T" desc:"Fill in {{.Name}}, {{.IP}}, {{.Tags}} and {{.Meta.key}} per host."`
 	}
-	cfg := &config{false, e.c.Timeout, false}
+	cfg := &config{false, e.c.Timeout, false, "", false}
 	f, err := reflectFlags("run", cfg, e.o)
 	if err != nil {
 		return err
@@ -302,84 +323,86 @@ func run(e Env, args []string) error {
 	if err := f.Parse(args); err != nil {
 		return err
 	}
+	hosts, err := targetHosts(e, cfg.Group)
+	if err != nil {
+		return err
+	}
+	if cfg.Group == "" {
+		hosts = selectedHosts(e, hosts)
+	}
 	cmdline := strings.Join(f.Args(), " ")
+	ct, err := newCmdTemplate(cmdline, cfg.Template)
+	if err != nil {
+		return errors.New("Bad command template: " + err.Error())
+	}
 	if cfg.Quiet {
 		o := NewOutput(e.o.DupeOuput())
 		o.Mute()
 		newEnv.o = o
 	}
+	id := e.s.StartRun(cmdline)
 	if cfg.Background {
-		go runEverywhere(cmdline, newEnv, cfg.Timeout)
+		go runEverywhere(id, ct, hosts, newEnv, cfg.Timeout)
+		e.o.Out("Run %d started.\n", id)
 		return nil
 	}
 	startTime := time.Now()
-	runEverywhere(cmdline, newEnv, cfg.Timeout)
-	e.o.Out("Done in %.2fs.\n", time.Since(startTime).Seconds())
+	runEverywhere(id, ct, hosts, newEnv, cfg.Timeout)
+	e.o.Out("Run %d done in %.2fs.\n", id, time.Since(startTime).Seconds())
 	return nil
 }
 
-func target(e Env, args []string) error {
-	var wg sync.WaitGroup
-	outbuf := new(bytes.Buffer)
-	errbuf := new(bytes.Buffer)
+const targetUsage = "Usage: target [--sync [--force]] [--from hosts|ansible|sshconfig|json <path> | args...], target --stop"
 
-	cmd := exec.Command(e.c.TargetCmd, args...)
-	// We expect a JSON blob on STDOUT.
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
+func target(e Env, args []string) error {
+	// Our own flags come first, anything after them is for the target
+	// command. With --from we read an inventory ourselves rather than
+	// running the target command.
+	reconcile, force, from := false, false, ""
+flags:
+	for len(args) > 0 {
+		switch {
+		case args[0] == "--sync":
+			reconcile, args = true, args[1:]
+		case args[0] == "--force":
+			force, args = true, args[1:]
+		case args[0] == "--stop":
+			if reconcile || force || from != "" || len(args) != 1 {
+				return errors.New(targetUsage)
+			}
+			return stopTarget(e)
+		case args[0] == "--from":
+			if len(args) < 2 {
+				return errors.New(targetUsage)
+			}
+			from, args = args[1], args[2:]
+		case strings.HasPrefix(args[0], "--from="):
+			from, args = strings.TrimPrefix(args[0], "--from="), args[1:]
+		default:
+			break flags
+		}
 	}
-	// We expect some plaintext to be sent to the user on STDERR.
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return err
+	if force && !reconcile {
+		return errors.New(targetUsage)
 	}
-	if err = cmd.Start(); err != nil {
-		e.o.Debug("cmd.Start(): %s\n", err)
-		return err
+	if from == "" {
+		return runTarget(e, args, reconcile, force)
 	}
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		_, err = io.Copy(outbuf, stdout)
-		if err != nil {
-			e.o.Debug("io.Copy() failed: %s\n", err)
-		}
-	}()
-	go func() {
-		defer wg.Done()
-		_, err := io.Copy(errbuf, stderr)
-		if err != nil {
-			e.o.Debug("io.Copy() failed: %s\n", err)
-		}
-	}()
-	wg.Wait()
-	if err := cmd.Wait(); err != nil {
-		var exitCode int
-		if ee, ok := err.(*exec.ExitError); ok {
-			if status, ok := ee.Sys().(syscall.WaitStatus); ok {
-				exitCode = status.ExitStatus()
-			} else {
-				e.o.Debug("Unknown exit code, faking it.\n")
-				exitCode = 255
-			}
-		} else {
-			e.o.Debug("Unknown exit code, faking it.\n")
-			exitCode = 255
-		}
-		e.o.Out(errbuf.String())
-		msg := fmt.Sprintf("Command returned non-zero (%d) exit.", exitCode)
-		return errors.New(msg)
+	if len(args) != 1 {
+		return errors.New(targetUsage)
 	}
-	e.o.Out(errbuf.String())
-	if len(outbuf.Bytes()) > 0 {
-		j := NewJSON(e)
-		n, err := j.LoadBlob(outbuf.Bytes())
-		if err != nil {
-			return errors.New("Load JSON from STDOUT: " + err.Error())
-		}
-		e.o.Out("Targeted %d hosts.\n", n)
+	servers, err := readInventory(from, args[0])
+	if err != nil {
+		return errors.New("Load " + from + " inventory: " + err.Error())
+	}
+	if reconcile {
+		return syncTargets(e, servers, force)
+	}
+	n, err := NewJSON(e).LoadServers(servers)
+	if err != nil {
+		return err
 	}
+	e.o.Out("Targeted %d hosts.\n", n)
 	return nil
 }
 
@@ -392,9 +415,11 @@ func clear(e Env, args []string) error {
 
 func summary(e Env, args []string) error {
 	type config struct {
-		Verbose bool `short:"v" desc:"Verbose output."`
+		Verbose bool   `short:"v" desc:"Verbose output."`
+		Group   string `short:"g" desc:"Only summarize this group."`
+		By      string `short:"b" desc:"Break the results down by this meta key or field."`
 	}
-	cfg := &config{false}
+	cfg := &config{false, "", ""}
 	f, err := reflectFlags("summary", cfg, e.o)
 	if err != nil {
 		return err
@@ -402,7 +427,14 @@ func summary(e Env, args []string) error {
 	if err := f.Parse(args); err != nil {
 		return err
 	}
-	printSummary(e, cfg.Verbose)
+	hosts, err := targetHosts(e, cfg.Group)
+	if err != nil {
+		return err
+	}
+	printSummary(e, hosts, cfg.Verbose)
+	if cfg.By != "" {
+		printBreakdown(e, hosts, cfg.By)
+	}
 	return nil
 }
 
@@ -432,15 +464,21 @@ func state(e Env, args []string) error {
 
 		e.o.Out("\t%s(%d)\n", state, count)
 	}
+	outputBastions(e)
+	outputFlaps(e, true)
 	return nil
 }
 
 func connect(e Env, args []string) error {
 	type config struct {
-		Background bool `short:"b" desc:"Run in the background, don't wait."`
-		Timeout    int  `short:"t" desc:"Connection timeout in seconds."`
-	}
-	cfg := &config{false, e.c.Timeout}
+		Background bool   `short:"b" desc:"Run in the background, don't wait."`
+		Timeout    int    `short:"t" desc:"Connection timeout in seconds."`
+		Retries    int    `short:"r" desc:"Number of times to retry a failed connection."`
+		RetryOn    string `long:"retry-on" desc:"Comma separated error kinds to retry on, or 'all'."`
+		RetryWait  int    `short:"w" long:"retry-wait" desc:"Seconds to wait before the first retry."`
+		Group      string `short:"g" desc:"Only connect this group."`
+	}
+	cfg := &config{false, e.c.Timeout, 0, "all", 1, ""}
 	f, err := reflectFlags("connect", cfg, e.o)
 	if err != nil {
 		return err
@@ -448,22 +486,260 @@ func connect(e Env, args []string) error {
 	if err := f.Parse(args); err != nil {
 		return err
 	}
+	rp, err := newRetryPolicy(cfg.Retries, cfg.RetryOn, cfg.RetryWait)
+	if err != nil {
+		return err
+	}
+	hosts, err := targetHosts(e, cfg.Group)
+	if err != nil {
+		return err
+	}
 	if cfg.Background {
-		go connectEverywhere(e, cfg.Timeout)
+		go connectEverywhere(e, hosts, cfg.Timeout, rp)
 		e.o.Out("Ok. Use the state command to track connection progress.\n")
 		return nil
 	}
 	totalTime := time.Now()
-	count := connectEverywhere(e, cfg.Timeout)
+	count := connectEverywhere(e, hosts, cfg.Timeout, rp)
 	e.o.Out("%d hosts in %.2fs.\n", count, time.Since(totalTime).Seconds())
 	return nil
 }
 
 func disco(e Env, args []string) error {
-	disconnectEverywhere(e, true)
+	type config struct {
+		Group string `short:"g" desc:"Only disconnect this group, and leave the bastions be."`
+	}
+	cfg := &config{""}
+	f, err := reflectFlags("disco", cfg, e.o)
+	if err != nil {
+		return err
+	}
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if cfg.Group == "" {
+		disconnectEverywhere(e, true)
+		return nil
+	}
+	hosts, err := groupHosts(e, cfg.Group)
+	if err != nil {
+		return err
+	}
+	e.o.Out("Disconnected %d hosts.\n", disconnectHosts(e, hosts))
+	return nil
+}
+
+func history(e Env, args []string) error {
+	runs := e.s.GetRuns()
+	if len(runs) == 0 {
+		e.o.Out("No runs yet.\n")
+		return nil
+	}
+	for i := range runs {
+		outputRunLine(e, runs[i])
+	}
+	return nil
+}
+
+func showRun(e Env, args []string) error {
+	type config struct {
+		Verbose bool `short:"v" desc:"List the hosts for each error."`
+	}
+	cfg := &config{false}
+	f, err := reflectFlags("show-run", cfg, e.o)
+	if err != nil {
+		return err
+	}
+	if err = f.Parse(args); err != nil {
+		return err
+	}
+	if len(f.Args()) != 1 {
+		return errors.New("Usage: show-run <id>")
+	}
+	rr, err := getRunArg(e, f.Args()[0])
+	if err != nil {
+		return err
+	}
+	printRunSummary(e, rr, cfg.Verbose)
+	return nil
+}
+
+func diffRun(e Env, args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: diff-run <a> <b>")
+	}
+	a, err := getRunArg(e, args[0])
+	if err != nil {
+		return err
+	}
+	b, err := getRunArg(e, args[1])
+	if err != nil {
+		return err
+	}
+	outputRunDiff(e, a, b)
+	return nil
+}
+
+func save(e Env, args []string) error {
+	path := e.c.StateFile
+	if len(args) > 0 {
+		path = args[0]
+	}
+	if path == "" {
+		return errors.New("No state file to save to.")
+	}
+	count, err := saveState(e, path)
+	if err != nil {
+		return err
+	}
+	e.o.Out("Saved %d hosts to %s.\n", count, path)
+	return nil
+}
+
+func selectCmd(e Env, args []string) error {
+	type config struct {
+		Clear bool `short:"c" desc:"Drop the selection, runs go to every target."`
+		List  bool `short:"l" desc:"List the selected targets."`
+	}
+	cfg := &config{false, false}
+	f, err := reflectFlags("select", cfg, e.o)
+	if err != nil {
+		return err
+	}
+	if err = f.Parse(args); err != nil {
+		return err
+	}
+	if cfg.Clear {
+		e.s.SetSelection(nil)
+	}
+	if f.NArg() > 0 {
+		pred, err := parseSelect(strings.Join(f.Args(), " "))
+		if err != nil {
+			return err
+		}
+		e.s.SetSelection(matchingHosts(e, e.s.GetHostKeys(), pred))
+	}
+	outputSelection(e, cfg.List)
+	return nil
+}
+
+func exclude(e Env, args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: exclude <expression>")
+	}
+	pred, err := parseSelect(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	hosts := selectedHosts(e, e.s.GetHostKeys())
+	var keep []string
+	for _, host := range hosts {
+		hi, err := e.s.GetHostInfo(host)
+		if err != nil {
+			e.o.Debug("GetHostInfo(): %s\n", err)
+			continue
+		}
+		if !pred(hi) {
+			keep = append(keep, host)
+		}
+	}
+	if keep == nil {
+		keep = []string{}
+	}
+	e.s.SetSelection(keep)
+	outputSelection(e, false)
 	return nil
 }
 
+func outputSelection(e Env, list bool) {
+	total := len(e.s.GetHostKeys())
+	sel := e.s.GetSelection()
+	if sel == nil {
+		e.o.Out("All %d targets are selected.\n", total)
+		return
+	}
+	e.o.Out("Selected %d of %d targets.\n", len(sel), total)
+	if list {
+		for i := range sel {
+			e.o.Out("\t%s\n", sel[i])
+		}
+	}
+}
+
+func agentAdd(e Env, args []string) error {
+	type config struct {
+		Confirm  bool   `short:"c" desc:"Ask with SSH_ASKPASS before every use of the key."`
+		Lifetime int    `short:"t" desc:"Remove the key after this many seconds."`
+		Dest     string `short:"d" desc:"Comma separated host patterns the key may be used on."`
+	}
+	cfg := &config{false, 0, ""}
+	f, err := reflectFlags("agent-add", cfg, e.o)
+	if err != nil {
+		return err
+	}
+	if err = f.Parse(args); err != nil {
+		return err
+	}
+	if len(f.Args()) != 1 {
+		return errors.New("Usage: agent-add [-c] [-t secs] [-d hosts] <keyfile>")
+	}
+	keyfile := expandTilde(f.Args()[0])
+	buf, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return err
+	}
+	if keyEncrypted(buf) {
+		return errors.New("Can't prompt for a passphrase here, decrypt " + keyfile + " first.")
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return err
+	}
+	e.s.GetMetaAgent().add(&agentKey{
+		signer:  signer,
+		comment: keyfile,
+		confirm: cfg.Confirm,
+		hosts:   parseAgentHosts(cfg.Dest),
+	}, time.Duration(cfg.Lifetime)*time.Second)
+	e.o.Out("Added %s %s\n", ssh.FingerprintSHA256(signer.PublicKey()), keyfile)
+	return nil
+}
+
+func agentList(e Env, args []string) error {
+	keys := e.s.GetMetaAgent().list()
+	if len(keys) == 0 {
+		e.o.Out("The agent has no keys.\n")
+		return nil
+	}
+	for i := range keys {
+		var limits []string
+		if keys[i].confirm {
+			limits = append(limits, "confirm")
+		}
+		if !keys[i].expires.IsZero() {
+			left := time.Until(keys[i].expires).Seconds()
+			limits = append(limits, fmt.Sprintf("expires in %.0fs", left))
+		}
+		if len(keys[i].hosts) > 0 {
+			limits = append(limits, "hosts "+strings.Join(keys[i].hosts, ","))
+		}
+		e.o.Out(
+			"%s %s %s\n",
+			ssh.FingerprintSHA256(keys[i].signer.PublicKey()),
+			keys[i].comment,
+			strings.Join(limits, ", "),
+		)
+	}
+	return nil
+}
+
+func agentRm(e Env, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: agent-rm <fingerprint>")
+	}
+	return e.s.GetMetaAgent().remove(args[0])
+}
+
 func quit(e Env, args []string) error {
 	return newCmdErr(true, "byte!\n")
 }
@@ -474,8 +750,18 @@ func abort(e Env, a []string) error {
 }
 
 func runCliCmd(e Env, cmd string, args []string) bool {
+	entry := auditEntry{
+		Event:   auditCommand,
+		Command: strings.Join(append([]string{cmd}, args...), " "),
+	}
 	if _, ok := commands[cmd]; ok {
+		startTime := time.Now()
 		err := commands[cmd].cmd(e, args)
+		entry.Seconds = time.Since(startTime).Seconds()
+		if err != nil && err != pflag.ErrHelp {
+			entry.Error = err.Error()
+		}
+		audit(e, entry)
 		if err != nil {
 			if err != pflag.ErrHelp {
 				e.o.Out("%s: %s\n", cmd, err)
@@ -488,6 +774,8 @@ func runCliCmd(e Env, cmd string, args []string) bool {
 		}
 	} else {
 		e.o.Out("Unknown command: '%s'.\n", cmd)
+		entry.Error = "unknown command"
+		audit(e, entry)
 	}
 	return true
 }
@@ -20,15 +20,18 @@ import (
 
 // Default option values.
 const (
-	BastionConnects   = 1               // Split the proxy load up a bit
-	Concurrency       = 65536           // SSH to this many boxes per iteration
-	ControlPath       = "/.ssh/control" // Location of the control master sockets
-	DefaultSSHKey     = "/.ssh/id_rsa"  // Default private key location
-	SSHHostKey        = "/.ssh/id_host" // Server's SSH host key to prevent MITM
-	SSHTimeout        = 60              // How long to wait for SSH to return
-	SpoolDir          = "/.ssh/spool"   // Where remote program output gets saved
-	DefaultTarget     = "/bin/target"   // External target program
-	KeepAliveInterval = 0               // Send keep-alives this often
+	BastionConnects   = 1                     // Split the proxy load up a bit
+	Concurrency       = 65536                 // SSH to this many boxes per iteration
+	ControlPath       = "/.ssh/control"       // Location of the control master sockets
+	DefaultSSHKey     = "/.ssh/id_rsa"        // Default private key location
+	SSHHostKey        = "/.ssh/id_host"       // Server's SSH host key to prevent MITM
+	SSHTimeout        = 60                    // How long to wait for SSH to return
+	SpoolDir          = "/.ssh/spool"         // Where remote program output gets saved
+	DefaultTarget     = "/bin/target"         // External target program
+	OpenSSHConfigFile = "/.ssh/config"        // The user's OpenSSH client config
+	KeepAliveInterval = 0                     // Send keep-alives this often
+	ReconnectMaxWait  = 300                   // Longest wait between reconnect attempts
+	StateFile         = "/.ssh/metassh.state" // Where state snapshots get saved
 )
 
 // Config is a structure that defines the various command line switches and
@@ -36,64 +39,113 @@ const (
 // to get names, types, and the tags in this structure in order to call the
 // appropriate pflag functions to set things up.
 type Config struct {
-	Agent        bool   `short:"a" desc:"Use ssh-agent auth. Limits concurrency to 128"`
-	BastionConns int    `short:"b" desc:"Number of connections to maintain to each bastion"`
-	Concurrency  int    `short:"c" desc:"Maximum number of concurrent SSH connections"`
-	ControlPath  string `desc:"Specify where to create the control master UNIX domain sockets"`
-	Debug        bool   `short:"d" desc:"Turn on debugging output"`
-	Daemonize    bool   `desc:"Daemonize the program; run in the background"`
-	Execute      bool   `short:"e" desc:"Execute a test command on the server after connecting"`
-	File         string `short:"f" desc:"JSON file describing our SSH targets"`
-	HostKey      string `desc:"Path of the SSH server's private host key"`
-	KeepAlive    int    `desc:"Send server keep alive messages every 'n' seconds"`
-	Key          string `short:"k" desc:"Private SSH key to use for client authentication"`
-	Password     bool   `short:"p" desc:"Prompt for a password for password auth fallback"`
-	Server       bool   `short:"s" desc:"Run in SSH server mode"`
-	Spool        bool   `desc:"Save remote execution output to the SpoolDir"`
-	SpoolDir     string `desc:"Specify path to save program execution output"`
-	TargetCmd    string `desc:"Specify external program to implement target functionality"`
-	Tee          bool   `desc:"Tee spooled output to stdout/stderr."`
-	TestCmd      string `desc:"Specify a test command to execute"`
-	Timeout      int    `short:"t" desc:"Number of seconds to wait for SSH connections to finish"`
-	User         string `short:"u" desc:"Specify the user to SSH in as"`
-	Verbose      bool   `short:"v" desc:"Enable verbose reporting"`
+	Agent          bool       `short:"a" desc:"Use ssh-agent auth"`
+	AgentCache     int        `desc:"Seconds to cache the agent's key list for, 0 asks it every time"`
+	AgentConns     int        `desc:"Number of connections to the agent to share sign requests over"`
+	AuditLog       string     `desc:"Append-only JSON lines log of commands run, off unless set"`
+	BastionBalance string     `desc:"How to spread work over bastion connections: least or rr"`
+	BastionChans   int        `desc:"Open another bastion connection once all have this many channels, 0 never does"`
+	BastionConns   int        `short:"b" desc:"Number of connections to maintain to each bastion"`
+	Concurrency    int        `short:"c" desc:"Maximum number of concurrent SSH connections"`
+	ControlPath    string     `desc:"Specify where to create the control master UNIX domain sockets"`
+	Debug          bool       `short:"d" desc:"Turn on debugging output"`
+	Daemonize      bool       `desc:"Daemonize the program; run in the background"`
+	Execute        bool       `short:"e" desc:"Execute a test command on the server after connecting"`
+	File           string     `short:"f" desc:"JSON file describing our SSH targets"`
+	HostKey        string     `desc:"Path of the SSH server's private host key"`
+	IdentityOrder  string     `desc:"Order to try identities in: certs, keys or given"`
+	KeepAlive      int        `desc:"Send server keep alive messages every 'n' seconds"`
+	Key            stringList `short:"k" desc:"Private SSH key to use for client authentication, can be repeated"`
+	MetricsListen  string     `long:"metrics-listen" desc:"Address to serve Prometheus metrics on at /metrics"`
+	Password       bool       `short:"p" desc:"Prompt for a password for password auth fallback"`
+	Reconnect      bool       `short:"r" desc:"Reconnect hosts and bastions that drop, with backoff"`
+	ReconnectMax   int        `desc:"Maximum number of seconds to wait between reconnect attempts"`
+	Restore        bool       `desc:"Restore targets from the StateFile and reconnect in the background"`
+	Server         bool       `short:"s" desc:"Run in SSH server mode"`
+	SocksListen    string     `long:"socks-listen" desc:"Address to serve a SOCKS5 proxy into the fleet on, implies server"`
+	Spool          bool       `desc:"Save remote execution output to the SpoolDir"`
+	SpoolDir       string     `desc:"Specify path to save program execution output"`
+	SpoolKeep      int        `desc:"Number of run spool directories to keep, 0 keeps them all"`
+	SSHConfig      string     `desc:"OpenSSH client config to read host settings from"`
+	StateFile      string     `desc:"Where to save state snapshots on shutdown and with the save command"`
+	TargetCmd      string     `desc:"Specify external program to implement target functionality"`
+	Tee            bool       `desc:"Tee spooled output to stdout/stderr."`
+	TestCmd        string     `desc:"Specify a test command to execute"`
+	Timeout        int        `short:"t" desc:"Number of seconds to wait for SSH connections to finish"`
+	User           string     `short:"u" desc:"Specify the user to SSH in as"`
+	Verbose        bool       `short:"v" desc:"Enable verbose reporting"`
 }
 
 // DefaultConfig returns you back a pointer to a Config structure that has
 // some reasonable program defaults.
 func DefaultConfig() *Config {
 	return &Config{
-		Agent:        false,
-		BastionConns: BastionConnects,
-		Concurrency:  Concurrency,
-		ControlPath:  os.Getenv("HOME") + ControlPath,
-		Debug:        false,
-		Daemonize:    false,
-		Execute:      false,
-		File:         "",
-		HostKey:      os.Getenv("HOME") + SSHHostKey,
-		KeepAlive:    KeepAliveInterval,
-		Key:          os.Getenv("HOME") + DefaultSSHKey,
-		Password:     false,
-		Server:       false,
-		Spool:        false,
-		SpoolDir:     os.Getenv("HOME") + SpoolDir,
-		TargetCmd:    os.Getenv("HOME") + DefaultTarget,
-		Tee:          false,
-		TestCmd:      TestCommand,
-		Timeout:      SSHTimeout,
-		User:         os.Getenv("USER"),
-		Verbose:      false,
+		Agent:          false,
+		AgentCache:     0,
+		AgentConns:     AgentConnections,
+		AuditLog:       "",
+		BastionBalance: BalanceLeastLoaded,
+		BastionChans:   0,
+		BastionConns:   BastionConnects,
+		Concurrency:    Concurrency,
+		ControlPath:    os.Getenv("HOME") + ControlPath,
+		Debug:          false,
+		Daemonize:      false,
+		Execute:        false,
+		File:           "",
+		HostKey:        os.Getenv("HOME") + SSHHostKey,
+		IdentityOrder:  IdentityOrderCerts,
+		KeepAlive:      KeepAliveInterval,
+		Key:            stringList{values: []string{os.Getenv("HOME") + DefaultSSHKey}},
+		MetricsListen:  "",
+		Password:       false,
+		Reconnect:      false,
+		ReconnectMax:   ReconnectMaxWait,
+		Restore:        false,
+		Server:         false,
+		SocksListen:    "",
+		Spool:          false,
+		SpoolDir:       os.Getenv("HOME") + SpoolDir,
+		SpoolKeep:      0,
+		SSHConfig:      os.Getenv("HOME") + OpenSSHConfigFile,
+		StateFile:      os.Getenv("HOME") + StateFile,
+		TargetCmd:      os.Getenv("HOME") + DefaultTarget,
+		Tee:            false,
+		TestCmd:        TestCommand,
+		Timeout:        SSHTimeout,
+		User:           os.Getenv("USER"),
+		Verbose:        false,
 	}
 }
 
+// A stringList is an option that can be given more than once. Giving it at
+// all replaces the default.
+type stringList struct {
+	values []string
+	set    bool
+}
+
+func (sl *stringList) String() string {
+	return strings.Join(sl.values, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	if !sl.set {
+		sl.values = nil
+		sl.set = true
+	}
+	sl.values = append(sl.values, value)
+	return nil
+}
+
 // reflectFlags takes as args a command name, a pointer to a structure and
 // an io.Writer.
 //
 // The flags argument is supposed to be a pointer to a structure containing
 // elements of type int, bool, or string, along with a tag for each element
 // in the struct that encodes the option's short name (like -h) and a
-// description that appears in the help for the command.
+// description that appears in the help for the command. The long name is
+// the lower-cased element name, unless there is a 'long' tag.
 //
 // This code uses reflection to figure out the type, value, and address of
 // each element in the passed in 'flags' stucture and then calls the
@@ -117,11 +169,18 @@ func reflectFlags(name string, flags interface{}, o io.Writer) (*flag.FlagSet, e
 		typeField := val.Type().Field(i)
 
 		name := strings.ToLower(typeField.Name)
+		if long := typeField.Tag.Get("long"); long != "" {
+			name = long
+		}
 		value := valueField.Interface()
 		short := typeField.Tag.Get("short")
 		desc := typeField.Tag.Get("desc")
 		ptr := unsafe.Pointer(valueField.Addr().Pointer())
 
+		if v, ok := valueField.Addr().Interface().(flag.Value); ok {
+			f.VarP(v, name, short, desc)
+			continue
+		}
 		switch valueField.Kind() {
 		case reflect.Float64:
 			f.Float64VarP((*float64)(ptr), name, short, value.(float64), desc)
@@ -9,23 +9,19 @@ package main
 
 import (
 	"sync"
-	"time"
 )
 
-func connectEverywhere(e Env, timeout int) int {
+// The connectEverywhere function connects the given targets, along with any
+// bastions they need.
+func connectEverywhere(e Env, hk []string, timeout int, rp retryPolicy) int {
 	var wg sync.WaitGroup
 
 	e.o.Debug("Connecting everywhere.\n")
 	if err := resolveProxies(e); err != nil {
 		e.o.ErrExit("proxy resolve failed: %s\n", err)
 	}
-	concurrency := e.c.Concurrency
-	if e.c.Agent {
-		concurrency = 128 // Agent can only handle 128 concurrent requests.
-	}
-	limiter := make(chan struct{}, concurrency)
+	limiter := make(chan struct{}, e.c.Concurrency)
 	j := 0
-	var hk = e.s.GetHostKeys()
 	for j = range hk {
 		hostname := hk[j]
 		if e.s.ConnExists(hostname) {
@@ -41,13 +37,13 @@ func connectEverywhere(e Env, timeout int) int {
 				e.o.Debug("GetHostInfo(): %s\n", err)
 				return
 			}
-			startTime := time.Now()
-			err = resolve(hi.chain, e, false, timeout)
+			attempts, err := connectWithRetries(me, hi.chain, e, timeout, rp)
 			e.s.SetConnectionStatus(setConnectionStatus{
 				hostName:    me,
 				connectedOK: err == nil,
-				connectTime: time.Since(startTime),
+				connectTime: attempts[len(attempts)-1].duration,
 				lastError:   err,
+				attempts:    attempts,
 			})
 			if err == nil && e.c.Execute {
 				runOnce(me, e.c.TestCmd, e, timeout)
@@ -60,19 +56,35 @@ func connectEverywhere(e Env, timeout int) int {
 
 func disconnectHost(e Env, host string) error {
 	respChan := make(chan cleanupResponse)
-	ci, err := e.s.GetConnInfo(host)
+	ci, err := e.s.TakeConnInfo(host)
 	if err != nil {
 		return err
 	}
 	ci.reqChan <- cleanupRequest{respChan}
 	<-respChan
-	e.s.DeleteConnInfo(host)
 	return nil
 }
 
-func disconnectEverywhere(e Env, Proxies bool) {
-	respChan := make(chan cleanupResponse)
+// The disconnectHosts function disconnects the given targets, leaving their
+// bastions connected, and returns how many it disconnected.
+func disconnectHosts(e Env, hosts []string) int {
+	count := 0
+	for i := range hosts {
+		if !e.s.ConnExists(hosts[i]) {
+			continue
+		}
+		if err := disconnectHost(e, hosts[i]); err != nil {
+			e.o.Debug("disconnectHost(): %s\n", err)
+			continue
+		}
+		count++
+	}
+	return count
+}
 
+func disconnectEverywhere(e Env, Proxies bool) {
+	// We're disconnecting on purpose, so don't reconnect anything.
+	e.s.CancelReconnects()
 	// Disconnect any 'in-flight' connections or runs.
 	e.s.TimeoutWaiters()
 	// Cleanup all the non-proxies first.
@@ -86,9 +98,9 @@ func disconnectEverywhere(e Env, Proxies bool) {
 		if ci.isProxy {
 			continue
 		}
-		ci.reqChan <- cleanupRequest{respChan}
-		<-respChan
-		e.s.DeleteConnInfo(ck[i])
+		if err := disconnectHost(e, ck[i]); err != nil {
+			e.o.Debug("disconnectHost(): %s\n", err)
+		}
 	}
 	if !Proxies {
 		return
@@ -108,9 +120,9 @@ func disconnectEverywhere(e Env, Proxies bool) {
 		if ci.isDirect {
 			continue
 		}
-		ci.reqChan <- cleanupRequest{respChan}
-		<-respChan
-		e.s.DeleteConnInfo(ck[i])
+		if err := disconnectHost(e, ck[i]); err != nil {
+			e.o.Debug("disconnectHost(): %s\n", err)
+		}
 	}
 	// Finally get the direct proxies.
 	ck = e.s.GetConnKeys()
@@ -124,10 +136,9 @@ func disconnectEverywhere(e Env, Proxies bool) {
 			e.o.Debug("Whaa, how did %s not get killed!?\n", ck[i])
 			continue
 		}
-		for i := 0; i < e.c.BastionConns; i++ {
-			ci.reqChan <- cleanupRequest{respChan}
-			<-respChan
+		// The balancer cleans up all of its connections in one go.
+		if err := disconnectHost(e, ck[i]); err != nil {
+			e.o.Debug("disconnectHost(): %s\n", err)
 		}
-		e.s.DeleteConnInfo(ck[i])
 	}
 }
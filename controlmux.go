@@ -25,9 +25,12 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // Grabbed from OpenSSH's mux.c
@@ -100,22 +103,35 @@ type Mux struct {
 	l           *net.UnixListener
 	e           Env
 	sesscounter uint32
+	agentOnce   sync.Once
+	agentErr    error
 }
 
 // NewMux initializes the Mux type, as well as creating the ControlMaster
 // UNIX domain socket, and firing off goroutines to listen on the socket
 // and to handle mux requests.
-func NewMux(me string, client *ssh.Client, e Env) (*Mux, error) {
+func NewMux(me string, port string, client *ssh.Client, e Env) (*Mux, error) {
 	var err error
 	m := &Mux{
 		me:     me,
 		client: client,
 		e:      e,
 	}
-	sockName := e.c.ControlPath + "/" + me + "_" + SSHPort
-	if _, err = os.Stat(sockName); os.IsExist(err) {
-		msg := fmt.Sprintf("Socket %s already exists.", sockName)
-		return nil, errors.New(msg)
+	host, _ := splitLink(me)
+	sockName := e.c.ControlPath + "/" + host + "_" + port
+	// Whoever uses the socket is one of us, since it's only ours to use.
+	m.e = withVia(e, "mux")
+	if m.e.who != nil {
+		m.e.who.Addr = sockName
+	}
+	if _, err = os.Stat(sockName); err == nil {
+		// A socket left behind by a dropped connection. Since we're
+		// reconnecting the same host, rebuild it at the same path.
+		m.e.o.Debug("%s: removing stale socket %s\n", me, sockName)
+		if err = os.Remove(sockName); err != nil {
+			msg := fmt.Sprintf("Socket %s already exists.", sockName)
+			return nil, errors.New(msg)
+		}
 	}
 	addr := &net.UnixAddr{Name: sockName, Net: "unix"}
 	m.l, err = net.ListenUnix("unix", addr)
@@ -307,6 +323,11 @@ func (m *Mux) handleControlMaster() {
 						continue
 					}
 				}
+				if nsm.WantAgent {
+					if err = m.forwardAgent(session); err != nil {
+						m.e.o.Debug("%s: agent forwarding failed: %s\n", m.me, err)
+					}
+				}
 				localStdin := os.NewFile(uintptr(inOutErr[0]), "/dev/stdin")
 				localStdout := os.NewFile(uintptr(inOutErr[1]), "/dev/stdout")
 				localStderr := os.NewFile(uintptr(inOutErr[2]), "/dev/stderr")
@@ -358,7 +379,16 @@ func (m *Mux) handleControlMaster() {
 					}
 					continue
 				}
-				go m.waiter(msg.conn, session, som.SessionID)
+				remote := nsm.Command
+				if remote == "" {
+					remote = "(shell)"
+				}
+				audit(m.e, auditEntry{
+					Event:   auditMux,
+					Remote:  remote,
+					Targets: []string{m.me},
+				})
+				go m.waiter(msg.conn, session, som.SessionID, remote)
 
 			default:
 				m.e.o.Debug("%s: Unhandled message: %x\n", m.me, msg.MsgType)
@@ -374,10 +404,29 @@ func (m *Mux) handleControlMaster() {
 	}
 }
 
-func (m *Mux) waiter(c *net.UnixConn, s *ssh.Session, sid uint32) {
+// The forwardAgent method gives a session our agent rather than the user's
+// own. Agent channels are per connection, so we only set that up once.
+func (m *Mux) forwardAgent(session *ssh.Session) error {
+	m.agentOnce.Do(func() {
+		ma := m.e.s.GetMetaAgent()
+		m.agentErr = agent.ForwardToAgent(m.client, ma.forHost(m.me, m.e))
+	})
+	if m.agentErr != nil {
+		return m.agentErr
+	}
+	return agent.RequestAgentForwarding(session)
+}
+
+func (m *Mux) waiter(c *net.UnixConn, s *ssh.Session, sid uint32, remote string) {
 	var exitCode uint32
+	startTime := time.Now()
 	err := s.Wait()
 
+	entry := auditEntry{
+		Event:   auditMuxDone,
+		Remote:  remote,
+		Targets: []string{m.me},
+	}
 	if err != nil {
 		ee, ok := err.(*ssh.ExitError)
 		if ok {
@@ -385,8 +434,12 @@ func (m *Mux) waiter(c *net.UnixConn, s *ssh.Session, sid uint32) {
 		} else {
 			m.e.o.Debug("Unknown exit code, faking it.\n")
 			exitCode = 255
+			entry.Error = err.Error()
 		}
 	}
+	entry.ExitCode = intPtr(int(exitCode))
+	entry.Seconds = time.Since(startTime).Seconds()
+	audit(m.e, entry)
 	em := exitMsg{
 		MsgType:   MuxSExitMessage,
 		SessionID: sid,
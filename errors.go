@@ -0,0 +1,161 @@
+/*
+ * errors.go
+ *
+ * Errors used to be grouped in the summary by lower-casing their text and
+ * looking for a handful of known phrases, which lumped everything else into
+ * one pile and broke whenever a library changed its wording. Now every place
+ * that can fail wraps its error in an opError that says what kind of error it
+ * is, and at which stage of connecting or running it happened.
+ *
+ */
+
+package main
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The kinds of errors we know about.
+const (
+	kindDial     = "dial"
+	kindAuth     = "auth"
+	kindHostKey  = "host key"
+	kindTimeout  = "timeout"
+	kindAbort    = "abort"
+	kindProxy    = "proxy"
+	kindProtocol = "protocol"
+	kindSession  = "session"
+	kindExit     = "exit status"
+	kindLocal    = "local"
+)
+
+// Where things were at when they went wrong.
+const (
+	stageDial      = "dial"
+	stageNetProxy  = "net proxy"
+	stageHandshake = "handshake"
+	stageProxy     = "proxy"
+	stageSession   = "session"
+	stageRun       = "run"
+)
+
+// errorKinds lists every kind, for the retry policy and such.
+var errorKinds = []string{
+	kindDial,
+	kindAuth,
+	kindHostKey,
+	kindTimeout,
+	kindAbort,
+	kindProxy,
+	kindProtocol,
+	kindSession,
+	kindExit,
+	kindLocal,
+}
+
+// An opError is an error along with its kind and the stage it happened at.
+// Its text is just that of the error it wraps.
+type opError struct {
+	kind    string
+	stage   string
+	err     error
+	offered []string // The identities the server turned down, for kindAuth
+}
+
+func (oe *opError) Error() string {
+	return oe.err.Error()
+}
+
+// The stageError function wraps err in an opError for the given stage,
+// working out the kind from the error itself. Errors that already are an
+// opError keep their kind and stage, since the first stage to fail is the
+// interesting one.
+func stageError(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*opError); ok {
+		return err
+	}
+	return &opError{kind: errorKindOf(stage, err), stage: stage, err: err}
+}
+
+// The kindError function wraps err in an opError when we already know its
+// kind, like for the timeouts we enforce ourselves.
+func kindError(kind, stage string, err error) error {
+	return &opError{kind: kind, stage: stage, err: err}
+}
+
+// The errorKindOf function figures out what kind of error err is. We look at
+// its type where we can, but the SSH library reports plenty of things, like
+// failed authentication, as plain errors so for those we have to go by the
+// text.
+func errorKindOf(stage string, err error) string {
+	switch err.(type) {
+	case *ssh.ExitError, *ssh.ExitMissingError:
+		return kindExit
+	case *ssh.OpenChannelError:
+		return kindProxy
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return kindTimeout
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "unable to authenticate"),
+		strings.Contains(msg, "no supported methods remain"):
+		return kindAuth
+	case strings.Contains(msg, "host key"):
+		return kindHostKey
+	case strings.Contains(msg, "too many open files"):
+		return kindLocal
+	case strings.Contains(msg, "no common algorithm"),
+		strings.Contains(msg, "unexpected packet"),
+		strings.Contains(msg, "handshake failed"):
+		return kindProtocol
+	case strings.Contains(msg, "timed out"),
+		strings.Contains(msg, "timeout"):
+		return kindTimeout
+	}
+	switch stage {
+	case stageDial:
+		return kindDial
+	case stageNetProxy, stageProxy:
+		return kindProxy
+	case stageHandshake:
+		return kindProtocol
+	case stageSession, stageRun:
+		return kindSession
+	}
+	return UnknownError
+}
+
+// The errorClass function returns the kind of an error, or UnknownError if
+// it never got one.
+func errorClass(err error) string {
+	if oe, ok := err.(*opError); ok {
+		return oe.kind
+	}
+	return UnknownError
+}
+
+// The errorStage function returns the stage an error happened at, if it's
+// known.
+func errorStage(err error) string {
+	if oe, ok := err.(*opError); ok {
+		return oe.stage
+	}
+	return ""
+}
+
+// The errorLabel function is how errors are grouped in the summary, by kind
+// and by stage.
+func errorLabel(err error) string {
+	if stage := errorStage(err); stage != "" {
+		return errorClass(err) + " (" + stage + ")"
+	}
+	return errorClass(err)
+}
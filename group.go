@@ -0,0 +1,146 @@
+/*
+ * group.go
+ *
+ * Groups are named sets of targets, so one connected pool can serve many
+ * cohorts without running 'target' over and over. You save the current
+ * selection as a group, pick a group to be the selection again later, or
+ * combine groups with union and minus, which makes the result the selection
+ * for you to save under a new name if you like. The run, connect, disco and
+ * summary commands take a -g to work on just one group.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const groupUsage = "Usage: group save|use|show|rm <name>, group union|minus <a> <b>, group list"
+
+func groupCmd(e Env, args []string) error {
+	if len(args) == 0 {
+		return errors.New(groupUsage)
+	}
+	sub, args := strings.ToLower(args[0]), args[1:]
+	switch {
+	case sub == "list" && len(args) == 0:
+		return groupList(e)
+	case sub == "save" && len(args) == 1:
+		hosts := selectedHosts(e, e.s.GetHostKeys())
+		e.s.SetGroup(args[0], hosts)
+		e.o.Out("Saved %d targets as group %s.\n", len(hosts), args[0])
+		return nil
+	case sub == "use" && len(args) == 1:
+		hosts, err := groupHosts(e, args[0])
+		if err != nil {
+			return err
+		}
+		e.s.SetSelection(hosts)
+		outputSelection(e, false)
+		return nil
+	case sub == "show" && len(args) == 1:
+		hosts, err := groupHosts(e, args[0])
+		if err != nil {
+			return err
+		}
+		e.o.Out("Group %s has %d targets.\n", args[0], len(hosts))
+		for i := range hosts {
+			e.o.Out("\t%s\n", hosts[i])
+		}
+		return nil
+	case sub == "rm" && len(args) == 1:
+		return e.s.DeleteGroup(args[0])
+	case (sub == "union" || sub == "minus") && len(args) == 2:
+		a, err := groupHosts(e, args[0])
+		if err != nil {
+			return err
+		}
+		b, err := groupHosts(e, args[1])
+		if err != nil {
+			return err
+		}
+		if sub == "union" {
+			e.s.SetSelection(hostUnion(a, b))
+		} else {
+			e.s.SetSelection(hostMinus(a, b))
+		}
+		outputSelection(e, false)
+		return nil
+	}
+	return errors.New(groupUsage)
+}
+
+func groupList(e Env) error {
+	names := e.s.GetGroupNames()
+	if len(names) == 0 {
+		e.o.Out("No groups.\n")
+		return nil
+	}
+	for i := range names {
+		hosts, err := groupHosts(e, names[i])
+		if err != nil {
+			e.o.Debug("groupHosts(): %s\n", err)
+			continue
+		}
+		e.o.Out("%-20s %d targets\n", names[i], len(hosts))
+	}
+	return nil
+}
+
+// The groupHosts function returns the targets in a group. Groups can name
+// hosts that have since been dropped from the targets, so we leave those
+// out.
+func groupHosts(e Env, name string) ([]string, error) {
+	members, err := e.s.GetGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{}
+	for i := range members {
+		if e.s.HostExists(members[i]) {
+			hosts = append(hosts, members[i])
+		}
+	}
+	return hosts, nil
+}
+
+// The targetHosts function returns the targets in group, or all of them if
+// group is empty.
+func targetHosts(e Env, group string) ([]string, error) {
+	if group == "" {
+		return e.s.GetHostKeys(), nil
+	}
+	return groupHosts(e, group)
+}
+
+func hostUnion(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	hosts := []string{}
+	for _, list := range [][]string{a, b} {
+		for i := range list {
+			if !seen[list[i]] {
+				seen[list[i]] = true
+				hosts = append(hosts, list[i])
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func hostMinus(a, b []string) []string {
+	drop := make(map[string]bool, len(b))
+	for i := range b {
+		drop[b[i]] = true
+	}
+	hosts := []string{}
+	for i := range a {
+		if !drop[a[i]] {
+			hosts = append(hosts, a[i])
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,179 @@
+/*
+ * history.go
+ *
+ * Every run used to just overwrite the run results in HostInfo, so there was
+ * no telling what happened two commands ago. The State now keeps the last
+ * RunHistory runs, each with an ID, and this file has what the history,
+ * show-run and diff-run commands need to make sense of them.
+ *
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"sort"
+	"strconv"
+)
+
+// An outputHash digests what a command prints as it goes by, so we can tell
+// if the output changed between runs without keeping any of it. That's the
+// only way to tell when it's spooled to disk rather than kept.
+type outputHash struct {
+	stdOut hash.Hash
+	stdErr hash.Hash
+}
+
+func newOutputHash() *outputHash {
+	return &outputHash{stdOut: sha256.New(), stdErr: sha256.New()}
+}
+
+func (oh *outputHash) sum() string {
+	h := sha256.New()
+	h.Write(oh.stdOut.Sum(nil))
+	h.Write(oh.stdErr.Sum(nil))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func getRunArg(e Env, arg string) (RunRecord, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return RunRecord{}, errors.New("Bad run ID: " + arg)
+	}
+	return e.s.GetRun(id)
+}
+
+// The outputRunLine function shows a one line summary of a run.
+func outputRunLine(e Env, rr RunRecord) {
+	ok := 0
+	for _, res := range rr.results {
+		if res.ok {
+			ok++
+		}
+	}
+	took := "running"
+	if !rr.finished.IsZero() {
+		took = strconv.FormatFloat(rr.finished.Sub(rr.started).Seconds(), 'f', 2, 64) + "s"
+	}
+	e.o.Out(
+		"%4d  %s  %d/%d ok  %-8s  %s\n",
+		rr.id,
+		rr.started.Format("Jan _2 15:04:05"),
+		ok,
+		len(rr.results),
+		took,
+		rr.cmd,
+	)
+}
+
+// The printRunSummary function is printSummary for a single run out of the
+// history, rather than for whatever HostInfo has now.
+func printRunSummary(e Env, rr RunRecord, verbose bool) {
+	errorCounts := make(map[string]int)
+	errorHosts := make(map[string][]string)
+	runTimeToHost := make(map[float64]string)
+	var runTimes []float64
+
+	outputRunLine(e, rr)
+	hosts := sortedRunHosts(rr)
+	for i := range hosts {
+		res := rr.results[hosts[i]]
+		runTimes = append(runTimes, res.runTime.Seconds())
+		runTimeToHost[res.runTime.Seconds()] = hosts[i]
+		if res.err != nil {
+			label := errorLabel(res.err)
+			errorCounts[label]++
+			errorHosts[label] = append(errorHosts[label], hosts[i])
+		}
+	}
+	if len(runTimes) == 0 {
+		return
+	}
+	qRun := newSamples(runTimes)
+	e.o.Out("Quantile:    1%%     25%%     50%%     90%%    99%%\n")
+	e.o.Out("         +-------+-------+-------+-------+------+\n")
+	e.o.Out("Run:      %05.2fs, %05.2fs, %05.2fs, %05.2fs, %05.2fs (%d samples)\n",
+		qRun.percentile(0.01),
+		qRun.percentile(0.25),
+		qRun.percentile(0.50),
+		qRun.percentile(0.90),
+		qRun.percentile(0.99),
+		len(qRun),
+	)
+	fail := 0
+	for _, count := range errorCounts {
+		fail += count
+	}
+	e.o.Out("\n\t%d run failures\n", fail)
+	outputErrors(e, errorCounts, errorHosts, verbose)
+	e.o.Out("\n")
+	fastSlow(e, "Run", qRun, runTimeToHost)
+}
+
+// The outputRunDiff function lists the hosts whose outcome or output is not
+// the same in run a and run b, including hosts that only took part in one
+// of them.
+func outputRunDiff(e Env, a, b RunRecord) {
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, rr := range []RunRecord{a, b} {
+		for host := range rr.results {
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	changed := 0
+	for i := range hosts {
+		ra, inA := a.results[hosts[i]]
+		rb, inB := b.results[hosts[i]]
+		var what string
+		switch {
+		case !inA:
+			what = "not in run " + strconv.Itoa(a.id) + " -> " + runOutcome(rb)
+		case !inB:
+			what = runOutcome(ra) + " -> not in run " + strconv.Itoa(b.id)
+		case runOutcome(ra) != runOutcome(rb):
+			what = runOutcome(ra) + " -> " + runOutcome(rb)
+		case ra.outputSum != rb.outputSum:
+			what = "output changed"
+		default:
+			continue
+		}
+		changed++
+		e.o.Out("\t%s: %s\n", hosts[i], what)
+	}
+	e.o.Out(
+		"%d of %d hosts changed between run %d and run %d.\n",
+		changed,
+		len(hosts),
+		a.id,
+		b.id,
+	)
+}
+
+func runOutcome(res runResult) string {
+	switch {
+	case res.ok:
+		return "ok"
+	case errorClass(res.err) == kindExit:
+		return "exit " + strconv.Itoa(res.exitCode)
+	case res.err != nil:
+		return errorLabel(res.err)
+	}
+	return UnknownError
+}
+
+func sortedRunHosts(rr RunRecord) []string {
+	hosts := make([]string, 0, len(rr.results))
+	for host := range rr.results {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
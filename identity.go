@@ -0,0 +1,254 @@
+/*
+ * identity.go
+ *
+ * We can have more than one identity to log in with: every --key, plus the
+ * SSH certificate sitting next to it as <key>-cert.pub, if there is one. Some
+ * hosts only take certificates and others only plain keys, so we offer all of
+ * them, in the order asked for with --identityorder. Certificates tend to be
+ * short-lived, so when one changes on disk we pick up the new one on the next
+ * connect rather than making you restart.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The orders we can try identities in.
+const (
+	IdentityOrderCerts = "certs" // All the certificates, then the plain keys
+	IdentityOrderKeys  = "keys"  // All the plain keys, then the certificates
+	IdentityOrderGiven = "given" // In --key order, each cert before its key
+	CertSuffix         = "-cert.pub"
+)
+
+// An identitySource hands out the signers to authenticate with, and can
+// tell us what one of them is called so we can say which ones didn't work.
+type identitySource interface {
+	Signers() ([]ssh.Signer, error)
+	Name(signer ssh.Signer) string
+}
+
+type identity struct {
+	name    string
+	signer  ssh.Signer
+	key     ssh.Signer // The private key a certificate goes with
+	cert    bool
+	modTime time.Time
+}
+
+// An identitySet is the identities we got from --key.
+type identitySet struct {
+	mu  sync.Mutex
+	ids []*identity
+	e   Env
+}
+
+// The newIdentitySet function makes signers out of the keys in fps, which
+// are named by keys, and loads whatever certificates go with them.
+func newIdentitySet(keys []string, fps []*os.File, order string, e Env) (*identitySet, error) {
+	if len(keys) != len(fps) {
+		return nil, errors.New("Got a different number of keys than key names.")
+	}
+	var plain, certs, given []*identity
+	for i := range fps {
+		signer, err := makeSigner(fps[i], e)
+		if err != nil {
+			return nil, errors.New(keys[i] + ": " + err.Error())
+		}
+		key := &identity{name: keys[i], signer: signer}
+		plain = append(plain, key)
+		cert := &identity{name: keys[i] + CertSuffix, key: signer, cert: true}
+		if err = cert.load(); err != nil {
+			if !os.IsNotExist(err) {
+				e.o.Err("Can't load certificate %s: %s\n", cert.name, err)
+			}
+			given = append(given, key)
+			continue
+		}
+		if certExpired(cert.signer) {
+			e.o.Err("Certificate %s has expired.\n", cert.name)
+		}
+		certs = append(certs, cert)
+		given = append(given, cert, key)
+	}
+	is := &identitySet{e: e}
+	switch order {
+	case IdentityOrderCerts:
+		is.ids = append(certs, plain...)
+	case IdentityOrderKeys:
+		is.ids = append(plain, certs...)
+	case IdentityOrderGiven:
+		is.ids = given
+	default:
+		return nil, errors.New("Unknown identity order: " + order)
+	}
+	return is, nil
+}
+
+// The load method reads a certificate off the disk and pairs it with its
+// key, if it has changed since we last looked.
+func (id *identity) load() error {
+	fi, err := os.Stat(id.name)
+	if err != nil {
+		return err
+	}
+	if id.signer != nil && fi.ModTime().Equal(id.modTime) {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(id.name)
+	if err != nil {
+		return err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return errors.New("Not a certificate.")
+	}
+	signer, err := ssh.NewCertSigner(cert, id.key)
+	if err != nil {
+		return err
+	}
+	id.signer = signer
+	id.modTime = fi.ModTime()
+	return nil
+}
+
+func certExpired(signer ssh.Signer) bool {
+	cert, ok := signer.PublicKey().(*ssh.Certificate)
+	if !ok || cert.ValidBefore == ssh.CertTimeInfinity {
+		return false
+	}
+	return time.Now().Unix() >= int64(cert.ValidBefore)
+}
+
+// The Signers method hands out our signers in order. Certificates that have
+// expired are left out, since servers only let you fail so many times.
+func (is *identitySet) Signers() ([]ssh.Signer, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	var signers []ssh.Signer
+	for i := range is.ids {
+		id := is.ids[i]
+		if id.cert {
+			if err := id.load(); err != nil {
+				is.e.o.Debug("Reloading %s: %s\n", id.name, err)
+			}
+			if certExpired(id.signer) {
+				continue
+			}
+		}
+		signers = append(signers, id.signer)
+	}
+	return signers, nil
+}
+
+// The Name method returns the name of the identity signer came from, or ""
+// if it isn't one of ours.
+func (is *identitySet) Name(signer ssh.Signer) string {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	for i := range is.ids {
+		if is.ids[i].signer != nil && sameKey(is.ids[i].signer, signer) {
+			return is.ids[i].name
+		}
+	}
+	return ""
+}
+
+func sameKey(a, b ssh.Signer) bool {
+	return bytes.Equal(a.PublicKey().Marshal(), b.PublicKey().Marshal())
+}
+
+// An offerLog keeps track of the signers handed out for a handshake, so that
+// when authentication fails we can say which identities the server turned
+// down, rather than which ones we think we'd have offered.
+type offerLog struct {
+	oc      *OpenSSHConfig
+	ids     identitySource
+	mu      sync.Mutex
+	signers []ssh.Signer
+	seen    map[string]bool
+}
+
+func newOfferLog(oc *OpenSSHConfig, ids identitySource) *offerLog {
+	return &offerLog{oc: oc, ids: ids, seen: make(map[string]bool)}
+}
+
+// The wrap method returns a signers callback for ssh.PublicKeysCallback that
+// notes down whatever f hands out.
+func (ol *offerLog) wrap(f func() ([]ssh.Signer, error)) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		signers, err := f()
+		ol.mu.Lock()
+		defer ol.mu.Unlock()
+		// Extra connections to a bastion share the log, so each key only
+		// goes in once.
+		for i := range signers {
+			key := string(signers[i].PublicKey().Marshal())
+			if !ol.seen[key] {
+				ol.seen[key] = true
+				ol.signers = append(ol.signers, signers[i])
+			}
+		}
+		return signers, err
+	}
+}
+
+// The names method returns the names of the identities that were offered,
+// in the order they were offered.
+func (ol *offerLog) names() []string {
+	ol.mu.Lock()
+	defer ol.mu.Unlock()
+	names := make([]string, 0, len(ol.signers))
+	for _, signer := range ol.signers {
+		names = append(names, ol.name(signer))
+	}
+	return names
+}
+
+func (ol *offerLog) name(signer ssh.Signer) string {
+	if ol.oc != nil {
+		for name, id := range ol.oc.identities {
+			if sameKey(id, signer) {
+				return name
+			}
+		}
+	}
+	if ol.ids != nil {
+		if name := ol.ids.Name(signer); name != "" {
+			return name
+		}
+	}
+	return ssh.FingerprintSHA256(signer.PublicKey())
+}
+
+// The withOffered function notes which identities were offered on err, if
+// it's an authentication failure.
+func withOffered(err error, ol *offerLog) error {
+	if oe, ok := err.(*opError); ok && oe.kind == kindAuth && ol != nil {
+		oe.offered = ol.names()
+	}
+	return err
+}
+
+// The offeredIdentities function returns the identities that were offered
+// before err, if it's an authentication failure.
+func offeredIdentities(err error) []string {
+	if oe, ok := err.(*opError); ok {
+		return oe.offered
+	}
+	return nil
+}
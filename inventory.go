@@ -0,0 +1,610 @@
+/*
+ * inventory.go
+ *
+ * Not everyone has a 'target' program that knows how to spit out our JSON,
+ * so 'target --from <format> <path>' reads a few common inventory formats
+ * itself:
+ *
+ *	hosts      A plain list of hosts, one per line, as host, host:port or
+ *	           user@host:port. Blank lines and # comments are skipped.
+ *	ansible    An Ansible inventory, INI or YAML. Groups become tags, other
+ *	           variables become meta, ansible_host, ansible_user and
+ *	           ansible_port say where to go, and jump hosts in
+ *	           ansible_ssh_common_args become the chain.
+ *	sshconfig  The Host entries of an ssh_config, the ones without wildcards.
+ *	json       Our own JSON, from a file.
+ *
+ * They all turn the inventory into Servers and load them the same way the
+ * JSON from 'target' gets loaded.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// The inventory formats 'target --from' understands.
+const (
+	InventoryHosts     = "hosts"
+	InventoryAnsible   = "ansible"
+	InventorySSHConfig = "sshconfig"
+	InventoryJSON      = "json"
+)
+
+// The readInventory function reads the inventory at path and returns the
+// hosts in it.
+func readInventory(format, path string) ([]Server, error) {
+	buf, err := ioutil.ReadFile(expandTilde(path))
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case InventoryHosts:
+		return parseHostList(buf)
+	case InventoryAnsible:
+		return parseAnsible(buf, path)
+	case InventorySSHConfig:
+		return parseSSHConfigHosts(buf)
+	case InventoryJSON:
+		return parseServers(buf)
+	}
+	return nil, errors.New("Unknown inventory format: " + format)
+}
+
+// The applyTargetUser function logs in as the user the inventory gave for
+// the target that link leads to, if it gave one. That beats the User in the
+// OpenSSH config, the same as a user on the ssh command line would.
+func applyTargetUser(cfg *ssh.ClientConfig, link string, e Env) {
+	hi, err := e.s.GetHostInfo(e.s.GetPTR(link))
+	if err == nil && hi.user != "" {
+		cfg.User = hi.user
+	}
+}
+
+// The linkServer function makes a Server out of a user@host:port link.
+func linkServer(link string) Server {
+	var srv Server
+	srv.User, link = linkUser(link)
+	host, port := splitLink(link)
+	srv.Name = host
+	srv.Port, _ = strconv.Atoi(port)
+	return srv
+}
+
+func parseHostList(buf []byte) ([]Server, error) {
+	var servers []Server
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		servers = append(servers, linkServer(line))
+	}
+	return servers, scanner.Err()
+}
+
+// The parseSSHConfigHosts function makes targets out of the Host lines of an
+// ssh_config. Patterns are left out, since we can't connect to a pattern.
+// The file may not be the one we use for connecting, so whatever it says
+// about HostName, Port and ProxyJump is written into the chain, along with
+// the User of the jump hosts, and the target's User goes into the target.
+func parseSSHConfigHosts(buf []byte) ([]Server, error) {
+	oc := new(OpenSSHConfig)
+	if err := oc.parse(bytes.NewReader(buf), 0, nil); err != nil {
+		return nil, err
+	}
+	var servers []Server
+	seen := make(map[string]bool)
+	for i := range oc.blocks {
+		for _, name := range oc.blocks[i].patterns {
+			if strings.ContainsAny(name, "*?!") || seen[name] || !oc.blocks[i].matches(name) {
+				continue
+			}
+			seen[name] = true
+			chain := oc.Chain(name)
+			for j := range chain {
+				hc := oc.Lookup(chain[j])
+				user, _ := linkUser(chain[j])
+				if user == "" && j < len(chain)-1 {
+					user = hc.user
+				}
+				chain[j] = joinLink(hc.hostPort(chain[j]))
+				if user != "" {
+					chain[j] = user + "@" + chain[j]
+				}
+			}
+			servers = append(servers, Server{
+				Name:  name,
+				Chain: strings.Join(chain, " "),
+				User:  oc.Lookup(name).user,
+			})
+		}
+	}
+	return servers, nil
+}
+
+// An ansibleInventory is an Ansible inventory boiled down to the bits we
+// care about, whether it came from INI or YAML.
+type ansibleInventory struct {
+	groups   map[string]*ansibleGroup
+	hostVars map[string]map[string]string
+	hosts    []string // In the order we first saw them
+}
+
+type ansibleGroup struct {
+	hosts    []string
+	vars     map[string]string
+	children []string
+}
+
+func newAnsibleInventory() *ansibleInventory {
+	return &ansibleInventory{
+		groups:   make(map[string]*ansibleGroup),
+		hostVars: make(map[string]map[string]string),
+	}
+}
+
+func (inv *ansibleInventory) group(name string) *ansibleGroup {
+	g, exists := inv.groups[name]
+	if !exists {
+		g = &ansibleGroup{vars: make(map[string]string)}
+		inv.groups[name] = g
+	}
+	return g
+}
+
+func (inv *ansibleInventory) addHost(group, host string, vars map[string]string) {
+	if _, exists := inv.hostVars[host]; !exists {
+		inv.hostVars[host] = make(map[string]string)
+		inv.hosts = append(inv.hosts, host)
+	}
+	for k, v := range vars {
+		inv.hostVars[host][k] = v
+	}
+	g := inv.group(group)
+	g.hosts = append(g.hosts, host)
+}
+
+// The parseAnsible function reads an Ansible inventory. YAML ones usually
+// say so with their extension, otherwise INI ones start with a [group].
+func parseAnsible(buf []byte, path string) ([]Server, error) {
+	var inv *ansibleInventory
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		inv, err = parseAnsibleYAML(buf)
+	case ".ini":
+		inv, err = parseAnsibleINI(buf)
+	default:
+		if looksLikeINI(buf) {
+			inv, err = parseAnsibleINI(buf)
+		} else {
+			inv, err = parseAnsibleYAML(buf)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return inv.servers(), nil
+}
+
+func looksLikeINI(buf []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		return line[0] == '[' || !strings.Contains(line, ":")
+	}
+	return true
+}
+
+func parseAnsibleINI(buf []byte) (*ansibleInventory, error) {
+	inv := newAnsibleInventory()
+	group, kind := "ungrouped", ""
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: bad section %s", n, line)
+			}
+			group, kind = line[1:len(line)-1], ""
+			if i := strings.Index(group, ":"); i >= 0 {
+				group, kind = group[:i], group[i+1:]
+			}
+			inv.group(group)
+			continue
+		}
+		fields := splitINIFields(line)
+		switch kind {
+		case "":
+			vars := make(map[string]string)
+			for _, f := range fields[1:] {
+				if i := strings.Index(f, "="); i > 0 {
+					vars[f[:i]] = f[i+1:]
+				}
+			}
+			hosts, err := expandHostPattern(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			for i := range hosts {
+				inv.addHost(group, hosts[i], vars)
+			}
+		case "vars":
+			i := strings.Index(line, "=")
+			if i < 0 {
+				return nil, fmt.Errorf("line %d: expected key=value", n)
+			}
+			key := strings.TrimSpace(line[:i])
+			inv.group(group).vars[key] = unquote(strings.TrimSpace(line[i+1:]))
+		case "children":
+			g := inv.group(group)
+			g.children = append(g.children, fields[0])
+			inv.group(fields[0])
+		default:
+			return nil, fmt.Errorf("line %d: unknown section type %s", n, kind)
+		}
+	}
+	return inv, scanner.Err()
+}
+
+// The splitINIFields function splits a host line on whitespace, except
+// inside quotes, which it takes off.
+func splitINIFields(line string) []string {
+	var fields []string
+	var cur []rune
+	var quote rune
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			cur = append(cur, r)
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ' ' || r == '\t':
+			if len(cur) > 0 {
+				fields = append(fields, string(cur))
+				cur = nil
+			}
+		default:
+			cur = append(cur, r)
+		}
+	}
+	if len(cur) > 0 {
+		fields = append(fields, string(cur))
+	}
+	return fields
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// The expandHostPattern function expands Ansible host ranges, like
+// web[01:20:2].example.com or db-[a:c].
+func expandHostPattern(pattern string) ([]string, error) {
+	open := strings.Index(pattern, "[")
+	if open < 0 {
+		return []string{pattern}, nil
+	}
+	end := strings.Index(pattern[open:], "]")
+	if end < 0 {
+		return nil, errors.New("unterminated range in " + pattern)
+	}
+	end += open
+	prefix, suffix := pattern[:open], pattern[end+1:]
+	parts := strings.Split(pattern[open+1:end], ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, errors.New("bad range in " + pattern)
+	}
+	stride := 1
+	if len(parts) == 3 {
+		var err error
+		if stride, err = strconv.Atoi(parts[2]); err != nil || stride < 1 {
+			return nil, errors.New("bad stride in " + pattern)
+		}
+	}
+	var middles []string
+	if from, err := strconv.Atoi(parts[0]); err == nil {
+		to, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, errors.New("bad range in " + pattern)
+		}
+		width := 0
+		if len(parts[0]) > 1 && parts[0][0] == '0' {
+			width = len(parts[0])
+		}
+		for i := from; i <= to; i += stride {
+			middles = append(middles, fmt.Sprintf("%0*d", width, i))
+		}
+	} else if len(parts[0]) == 1 && len(parts[1]) == 1 {
+		for c := parts[0][0]; c <= parts[1][0]; c += byte(stride) {
+			middles = append(middles, string(c))
+			if int(c)+stride > 255 {
+				break
+			}
+		}
+	} else {
+		return nil, errors.New("bad range in " + pattern)
+	}
+	rests, err := expandHostPattern(suffix)
+	if err != nil {
+		return nil, err
+	}
+	var hosts []string
+	for i := range middles {
+		for j := range rests {
+			hosts = append(hosts, prefix+middles[i]+rests[j])
+		}
+	}
+	return hosts, nil
+}
+
+// A yamlGroup is a group in a YAML inventory.
+type yamlGroup struct {
+	Hosts    map[string]map[string]interface{} `yaml:"hosts"`
+	Vars     map[string]interface{}            `yaml:"vars"`
+	Children map[string]*yamlGroup             `yaml:"children"`
+}
+
+func parseAnsibleYAML(buf []byte) (*ansibleInventory, error) {
+	var top map[string]*yamlGroup
+	if err := yaml.Unmarshal(buf, &top); err != nil {
+		return nil, err
+	}
+	inv := newAnsibleInventory()
+	for _, name := range sortedGroupNames(top) {
+		if err := inv.addYAMLGroup(name, top[name]); err != nil {
+			return nil, err
+		}
+	}
+	return inv, nil
+}
+
+func sortedGroupNames(m map[string]*yamlGroup) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (inv *ansibleInventory) addYAMLGroup(name string, yg *yamlGroup) error {
+	g := inv.group(name)
+	if yg == nil {
+		return nil
+	}
+	for k, v := range metaStrings(yg.Vars) {
+		g.vars[k] = v
+	}
+	patterns := make([]string, 0, len(yg.Hosts))
+	for pattern := range yg.Hosts {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		hosts, err := expandHostPattern(pattern)
+		if err != nil {
+			return err
+		}
+		vars := metaStrings(yg.Hosts[pattern])
+		for i := range hosts {
+			inv.addHost(name, hosts[i], vars)
+		}
+	}
+	for _, child := range sortedGroupNames(yg.Children) {
+		g.children = append(g.children, child)
+		if err := inv.addYAMLGroup(child, yg.Children[child]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The groupsOf method returns the groups a host is in, including the ones
+// it's in by way of children, in the order Ansible applies their variables:
+// by depth below all, then by name, so child groups beat their parents no
+// matter how the host got into them.
+func (inv *ansibleInventory) groupsOf(host string) []string {
+	parents := make(map[string][]string)
+	for name, g := range inv.groups {
+		for i := range g.children {
+			parents[g.children[i]] = append(parents[g.children[i]], name)
+		}
+	}
+	in := make(map[string]bool)
+	var queue []string
+	for name, g := range inv.groups {
+		for i := range g.hosts {
+			if g.hosts[i] == host {
+				in[name] = true
+				queue = append(queue, name)
+				break
+			}
+		}
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, p := range parents[name] {
+			if !in[p] {
+				in[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+	depths := make(map[string]int)
+	groups := make([]string, 0, len(in))
+	for name := range in {
+		groups = append(groups, name)
+	}
+	sort.Slice(groups, func(a, b int) bool {
+		da := groupDepth(groups[a], parents, depths, 0)
+		db := groupDepth(groups[b], parents, depths, 0)
+		if da != db {
+			return da < db
+		}
+		return groups[a] < groups[b]
+	})
+	return groups
+}
+
+// The groupDepth function returns how far down from all a group is, by its
+// longest way down, like Ansible does. Everything but all is at least one
+// down, whether or not it's listed as a child of all.
+func groupDepth(name string, parents map[string][]string, depths map[string]int, seen int) int {
+	if name == "all" {
+		return 0
+	}
+	if d, exists := depths[name]; exists {
+		return d
+	}
+	depth := 1
+	// Children can loop back on themselves, so don't go round forever.
+	if seen < len(parents) {
+		for _, p := range parents[name] {
+			if d := groupDepth(p, parents, depths, seen+1) + 1; d > depth {
+				depth = d
+			}
+		}
+	}
+	depths[name] = depth
+	return depth
+}
+
+// The servers method turns the inventory into targets.
+func (inv *ansibleInventory) servers() []Server {
+	var servers []Server
+	for _, host := range inv.hosts {
+		vars := make(map[string]string)
+		if all, exists := inv.groups["all"]; exists {
+			for k, v := range all.vars {
+				vars[k] = v
+			}
+		}
+		var tags []string
+		for _, name := range inv.groupsOf(host) {
+			if name == "all" {
+				continue
+			}
+			for k, v := range inv.groups[name].vars {
+				vars[k] = v
+			}
+			if name != "ungrouped" {
+				tags = append(tags, name)
+			}
+		}
+		for k, v := range inv.hostVars[host] {
+			vars[k] = v
+		}
+		sort.Strings(tags)
+		srv := Server{Name: host, Tags: tags}
+		link := host
+		meta := make(map[string]interface{})
+		for k, v := range vars {
+			switch k {
+			case "ansible_host", "ansible_ssh_host":
+				link = v
+			case "ansible_user", "ansible_ssh_user":
+				srv.User = v
+			case "ansible_port", "ansible_ssh_port":
+				srv.Port, _ = strconv.Atoi(v)
+			default:
+				if !strings.HasPrefix(k, "ansible_") {
+					meta[k] = v
+				}
+			}
+		}
+		srv.Meta = meta
+		jumps := sshArgsJumps(vars["ansible_ssh_common_args"] + " " + vars["ansible_ssh_extra_args"])
+		srv.Chain = strings.Join(append(jumps, link), " ")
+		servers = append(servers, srv)
+	}
+	return servers
+}
+
+// The sshArgsJumps function digs the jump hosts out of ssh arguments, given
+// with -J, -o ProxyJump=, or a ProxyCommand that runs ssh -W. Users on the
+// jump hosts are kept, as user@host links.
+func sshArgsJumps(args string) []string {
+	fields := strings.Fields(strings.NewReplacer(`"`, " ", "'", " ").Replace(args))
+	var jump string
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		lower := strings.ToLower(f)
+		switch {
+		case f == "-J" && i+1 < len(fields):
+			jump = fields[i+1]
+			i++
+		case strings.HasPrefix(f, "-J"):
+			jump = f[2:]
+		case strings.Contains(lower, "proxyjump="):
+			jump = f[strings.Index(lower, "proxyjump=")+len("proxyjump="):]
+		case strings.Contains(lower, "proxycommand="):
+			if host := proxyCommandHost(fields[i+1:]); host != "" {
+				jump = host
+			}
+		}
+	}
+	var jumps []string
+	for _, j := range strings.Split(jump, ",") {
+		if j = strings.TrimSpace(j); j != "" {
+			jumps = append(jumps, j)
+		}
+	}
+	return jumps
+}
+
+// The proxyCommandHost function finds the host in the rest of an 'ssh -W
+// %h:%p bastion' ProxyCommand, with the user from -l if there is one.
+func proxyCommandHost(fields []string) string {
+	if len(fields) > 0 && fields[0] == "ssh" {
+		fields = fields[1:]
+	}
+	var user string
+	for i := 0; i < len(fields); i++ {
+		f := fields[i]
+		switch {
+		case f == "-l" && i+1 < len(fields):
+			user = fields[i+1]
+			i++
+		case len(f) == 2 && strings.Contains("WpiJoFE", f[1:]) && f[0] == '-':
+			i++
+		case strings.HasPrefix(f, "-"), strings.HasPrefix(f, "%"):
+		default:
+			if u, _ := linkUser(f); u == "" && user != "" {
+				return user + "@" + f
+			}
+			return f
+		}
+	}
+	return ""
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestExpandHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+		wantErr string
+	}{
+		{"db-1", []string{"db-1"}, ""},
+		{"web[1:3]", []string{"web1", "web2", "web3"}, ""},
+		{"web[01:03].example.com", []string{"web01.example.com", "web02.example.com", "web03.example.com"}, ""},
+		{"web[001:010:4]", []string{"web001", "web005", "web009"}, ""},
+		{"db-[a:c]", []string{"db-a", "db-b", "db-c"}, ""},
+		{"db-[a:e:2]", []string{"db-a", "db-c", "db-e"}, ""},
+		{"r[1:2]-n[a:b]", []string{"r1-na", "r1-nb", "r2-na", "r2-nb"}, ""},
+		{"web[3:1]", nil, ""},
+		{"web[1:3", nil, "unterminated range"},
+		{"web[1]", nil, "bad range"},
+		{"web[1:2:3:4]", nil, "bad range"},
+		{"web[1:x]", nil, "bad range"},
+		{"web[aa:bb]", nil, "bad range"},
+		{"web[1:3:0]", nil, "bad stride"},
+		{"web[1:3:-1]", nil, "bad stride"},
+		{"r[1:2]-n[a:", nil, "unterminated range"},
+	}
+	for _, tt := range tests {
+		got, err := expandHostPattern(tt.pattern)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.pattern, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.pattern, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+const testINI = `
+# A comment
+lonely ansible_host=10.0.0.9
+
+[web]
+web[1:2] ansible_user=deploy
+proxy.example.com ansible_port=2222 note="has spaces"
+
+[db]
+db-1 ansible_host=10.0.1.1 ansible_ssh_common_args='-o ProxyJump=ops@bastion:2200'
+
+[web:vars]
+tier=front
+owner = "web team"
+
+[prod:children]
+web
+db
+
+[prod:vars]
+tier=unknown
+env=prod
+`
+
+func TestParseAnsibleINI(t *testing.T) {
+	inv, err := parseAnsibleINI([]byte(testINI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHosts := []string{"lonely", "web1", "web2", "proxy.example.com", "db-1"}
+	if !reflect.DeepEqual(inv.hosts, wantHosts) {
+		t.Errorf("hosts: got %v, want %v", inv.hosts, wantHosts)
+	}
+	if got := inv.groups["web"].hosts; !reflect.DeepEqual(got, []string{"web1", "web2", "proxy.example.com"}) {
+		t.Errorf("web hosts: got %v", got)
+	}
+	if got := inv.groups["ungrouped"].hosts; !reflect.DeepEqual(got, []string{"lonely"}) {
+		t.Errorf("ungrouped hosts: got %v", got)
+	}
+	if got := inv.groups["prod"].children; !reflect.DeepEqual(got, []string{"web", "db"}) {
+		t.Errorf("prod children: got %v", got)
+	}
+	if got := inv.groups["web"].vars["owner"]; got != "web team" {
+		t.Errorf("web owner: got %q", got)
+	}
+	if got := inv.hostVars["proxy.example.com"]["note"]; got != "has spaces" {
+		t.Errorf("proxy note: got %q", got)
+	}
+
+	servers := make(map[string]Server)
+	for _, srv := range inv.servers() {
+		servers[srv.Name] = srv
+	}
+	tests := []struct {
+		name  string
+		chain string
+		user  string
+		port  int
+		tags  []string
+		meta  map[string]interface{}
+	}{
+		{"lonely", "10.0.0.9", "", 0, nil, map[string]interface{}{}},
+		{
+			"web1", "web1", "deploy", 0, []string{"prod", "web"},
+			map[string]interface{}{"tier": "front", "owner": "web team", "env": "prod"},
+		},
+		{
+			"proxy.example.com", "proxy.example.com", "", 2222, []string{"prod", "web"},
+			map[string]interface{}{"tier": "front", "owner": "web team", "env": "prod", "note": "has spaces"},
+		},
+		{
+			"db-1", "ops@bastion:2200 10.0.1.1", "", 0, []string{"db", "prod"},
+			map[string]interface{}{"tier": "unknown", "env": "prod"},
+		},
+	}
+	for _, tt := range tests {
+		srv, exists := servers[tt.name]
+		if !exists {
+			t.Errorf("%s: missing", tt.name)
+			continue
+		}
+		if srv.Chain != tt.chain || srv.User != tt.user || srv.Port != tt.port {
+			t.Errorf("%s: got chain %q user %q port %d, want %q %q %d",
+				tt.name, srv.Chain, srv.User, srv.Port, tt.chain, tt.user, tt.port)
+		}
+		if !reflect.DeepEqual(srv.Tags, tt.tags) {
+			t.Errorf("%s: got tags %v, want %v", tt.name, srv.Tags, tt.tags)
+		}
+		if !reflect.DeepEqual(srv.Meta, tt.meta) {
+			t.Errorf("%s: got meta %v, want %v", tt.name, srv.Meta, tt.meta)
+		}
+	}
+}
+
+func TestParseAnsibleINIErrors(t *testing.T) {
+	tests := []struct {
+		ini     string
+		wantErr string
+	}{
+		{"[web\nweb1", "line 1: bad section"},
+		{"[web:vars]\njust-a-key", "line 2: expected key=value"},
+		{"[web:hosts]\nweb1", "line 2: unknown section type hosts"},
+		{"\n\nweb[1:", "line 3: unterminated range"},
+	}
+	for _, tt := range tests {
+		_, err := parseAnsibleINI([]byte(tt.ini))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: got %v, want %q", tt.ini, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGroupsOf(t *testing.T) {
+	// A host that's directly in a parent group and in one of its children
+	// still gets the child's variables, like Ansible does.
+	ini := `
+[parent]
+h1
+
+[child]
+h1
+h2
+
+[zzz]
+h2
+
+[parent:children]
+child
+
+[grandparent:children]
+parent
+
+[parent:vars]
+who=parent
+[child:vars]
+who=child
+[zzz:vars]
+who=zzz
+[grandparent:vars]
+who=grandparent
+only=grandparent
+`
+	inv, err := parseAnsibleINI([]byte(ini))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host   string
+		groups []string
+		who    string
+	}{
+		// grandparent is 1 down, parent 2, child 3.
+		{"h1", []string{"grandparent", "parent", "child"}, "child"},
+		// zzz is only 1 down, so child wins despite its name.
+		{"h2", []string{"grandparent", "zzz", "parent", "child"}, "child"},
+		{"nobody", []string{}, ""},
+	}
+	for _, tt := range tests {
+		got := inv.groupsOf(tt.host)
+		if !reflect.DeepEqual(got, tt.groups) {
+			t.Errorf("%s: got groups %v, want %v", tt.host, got, tt.groups)
+		}
+	}
+	for _, srv := range inv.servers() {
+		for _, tt := range tests {
+			if srv.Name != tt.host {
+				continue
+			}
+			if srv.Meta["who"] != tt.who || srv.Meta["only"] != "grandparent" {
+				t.Errorf("%s: got meta %v, want who=%s", tt.host, srv.Meta, tt.who)
+			}
+		}
+	}
+
+	// Same depth goes by name, the later name winning.
+	inv, err = parseAnsibleINI([]byte("[b]\nh\n[a]\nh\n[a:vars]\nx=a\n[b:vars]\nx=b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inv.groupsOf("h"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("same depth: got %v", got)
+	}
+
+	// Groups that are their own grandchildren don't hang us.
+	inv, err = parseAnsibleINI([]byte("[a]\nh\n[a:children]\nb\n[b:children]\na\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := inv.groupsOf("h")
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("loop: got %v", got)
+	}
+}
+
+func TestSSHArgsJumps(t *testing.T) {
+	tests := []struct {
+		args string
+		want []string
+	}{
+		{"", nil},
+		{"-o StrictHostKeyChecking=no", nil},
+		{"-J bastion", []string{"bastion"}},
+		{"-J ops@bastion:2200", []string{"ops@bastion:2200"}},
+		{"-Jops@bastion", []string{"ops@bastion"}},
+		{"-J a@one,two", []string{"a@one", "two"}},
+		{"-o ProxyJump=ops@bastion", []string{"ops@bastion"}},
+		{`-o "ProxyJump=ops@bastion"`, []string{"ops@bastion"}},
+		{`-o ProxyCommand="ssh -W %h:%p -q ops@bastion"`, []string{"ops@bastion"}},
+		{`-o ProxyCommand="ssh -l ops -W %h:%p bastion"`, []string{"ops@bastion"}},
+		{`-o ProxyCommand="ssh -p 2200 -W %h:%p bastion"`, []string{"bastion"}},
+	}
+	for _, tt := range tests {
+		if got := sshArgsJumps(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseSSHConfigHostsJumpUsers(t *testing.T) {
+	config := `
+Host bastion
+	HostName 10.0.0.1
+	User ops
+
+Host db-1
+	ProxyJump bastion
+	User dba
+
+Host web-1
+	ProxyJump admin@bastion
+`
+	servers, err := parseSSHConfigHosts([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][2]string{
+		"bastion": {"10.0.0.1", "ops"},
+		"db-1":    {"ops@10.0.0.1 db-1", "dba"},
+		"web-1":   {"admin@10.0.0.1 web-1", ""},
+	}
+	for _, srv := range servers {
+		w, exists := want[srv.Name]
+		if !exists {
+			t.Errorf("unexpected server %s", srv.Name)
+			continue
+		}
+		if srv.Chain != w[0] || srv.User != w[1] {
+			t.Errorf("%s: got chain %q user %q, want %q %q", srv.Name, srv.Chain, srv.User, w[0], w[1])
+		}
+	}
+}
+
+func TestLinkUser(t *testing.T) {
+	tests := []struct {
+		link, user, host, port string
+	}{
+		{"bastion", "", "bastion", ""},
+		{"ops@bastion", "ops", "bastion", ""},
+		{"ops@bastion:2200", "ops", "bastion", "2200"},
+		{"ops@[fd00::1]:2200", "ops", "fd00::1", "2200"},
+		{"a@b@bastion", "a@b", "bastion", ""},
+	}
+	for _, tt := range tests {
+		user, _ := linkUser(tt.link)
+		host, port := splitLink(tt.link)
+		if user != tt.user || host != tt.host || port != tt.port {
+			t.Errorf("%s: got %q %q %q, want %q %q %q", tt.link, user, host, port, tt.user, tt.host, tt.port)
+		}
+	}
+}
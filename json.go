@@ -12,6 +12,7 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
+	"strconv"
 	"strings"
 )
 
@@ -30,10 +31,15 @@ type JSON struct {
 }
 
 // Server is a type that contains a minimal info about a host. The
-// structure tags make the JSON import easier.
+// structure tags make the JSON import easier. Tags and Meta are whatever the
+// 'target' command knows about the host, like its role or datacenter.
 type Server struct {
-	Name  string `json:"name"`
-	Chain string `json:"chain"`
+	Name  string                 `json:"name"`
+	Chain string                 `json:"chain"`
+	Port  int                    `json:"port"`
+	User  string                 `json:"user"`
+	Tags  []string               `json:"tags"`
+	Meta  map[string]interface{} `json:"meta"`
 }
 
 // LoadFile is a method that loads data from the JSON SSH dump file
@@ -49,10 +55,24 @@ func (j *JSON) LoadFile() (int, error) {
 // LoadBlob loads a JSON blob from the external 'target' command or
 // from LoadFile into the global HostInfo map.
 func (j *JSON) LoadBlob(jblob []byte) (int, error) {
-	err := json.Unmarshal(jblob, &j.Servers)
+	servers, err := parseServers(jblob)
 	if err != nil {
 		return 0, err
 	}
+	return j.LoadServers(servers)
+}
+
+// The parseServers function unmarshals a JSON array of servers.
+func parseServers(jblob []byte) ([]Server, error) {
+	var servers []Server
+	err := json.Unmarshal(jblob, &servers)
+	return servers, err
+}
+
+// LoadServers loads servers into the global HostInfo map, wherever we got
+// them from.
+func (j *JSON) LoadServers(servers []Server) (int, error) {
+	j.Servers = servers
 	count := 0
 	for i := range j.Servers {
 		srv := j.Servers[i]
@@ -60,11 +80,43 @@ func (j *JSON) LoadBlob(jblob []byte) (int, error) {
 			j.e.o.Debug("Duplicate HostInfo entry for: %s\n", srv.Name)
 			continue
 		}
-		j.e.s.SetHostInfo(HostInfo{
-			hostName: srv.Name,
-			chain:    strings.Split(srv.Chain, " "),
-		})
+		j.e.s.SetHostInfo(j.hostInfo(srv))
 		count++
 	}
 	return count, nil
 }
+
+// The hostInfo method works out the HostInfo for a server.
+func (j *JSON) hostInfo(srv Server) HostInfo {
+	oc := j.e.s.GetOpenSSHConfig()
+	// Without an explicit chain, we go wherever the ProxyJump
+	// settings in the user's OpenSSH config lead us.
+	chain := strings.Fields(srv.Chain)
+	var netProxy []string
+	if len(chain) > 0 && isNetProxy(chain[0]) {
+		netProxy, chain = chain[:1], chain[1:]
+	}
+	switch len(chain) {
+	case 0:
+		chain = oc.Chain(srv.Name)
+	case 1:
+		chain = oc.Chain(chain[0])
+	}
+	chain = append(netProxy, chain...)
+	// A port field applies to the target itself, unless the chain
+	// already has a port for it.
+	last := len(chain) - 1
+	if host, port := splitLink(chain[last]); srv.Port > 0 && port == "" {
+		chain[last] = joinLink(host, strconv.Itoa(srv.Port))
+	}
+	// The last link is what we actually connect to, so the PTR for
+	// it needs to lead back to the target's name.
+	return HostInfo{
+		hostName:  srv.Name,
+		ipAddress: chain[last],
+		chain:     chain,
+		user:      srv.User,
+		tags:      srv.Tags,
+		meta:      metaStrings(srv.Meta),
+	}
+}
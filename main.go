@@ -23,14 +23,15 @@ import (
 
 // Some hardcoded constants used throughout the program.
 const (
-	ServerPort   = "2222"          // Default port for SSH server feature
-	SSHPort      = "22"            // Stock SSH port
-	UnknownError = "unknown error" // When we can't string match on an error
-	ServerPrompt = "metassh> "     // Prompt you get when you SSH in
-	TestCommand  = "exit 0"        // Used to test remote command execution
-	TmpDir       = "/.ssh"         // Used for dicey ssh key manpulations
-	KeepAlive    = "keepalive@openssh.com"
-	SSHKeygen    = "/usr/bin/ssh-keygen"
+	ServerPort      = "2222"          // Default port for SSH server feature
+	SSHPort         = "22"            // Stock SSH port
+	UnknownError    = "unknown error" // When we can't classify an error
+	ServerPrompt    = "metassh> "     // Prompt you get when you SSH in
+	TestCommand     = "exit 0"        // Used to test remote command execution
+	KeepAlive       = "keepalive@openssh.com"
+	PassphraseTries = 3  // How many goes you get at a key's passphrase
+	FlapHistory     = 16 // How many connection flaps to remember per host
+	RunHistory      = 32 // How many runs to remember
 )
 
 // The Env struct contains some necessary program state that is passed around
@@ -39,11 +40,16 @@ type Env struct {
 	s *State
 	o *Output
 	c *Config
+	a *Audit
+	// Who we're doing things for, for the audit log.
+	who *auditClient
 }
 
 func main() {
 	var sshClientConfig *ssh.ClientConfig
-	var clientPrivateKey, serverPrivateKey *os.File
+	var clientPrivateKeys []*os.File
+	var serverPrivateKey *os.File
+	var ids identitySource
 
 	c := DefaultConfig()
 	f, err := reflectFlags(path.Base(os.Args[0]), c, nil)
@@ -60,7 +66,9 @@ func main() {
 	}
 	s := NewState()
 	o := NewOutput(os.Stdout, os.Stderr, false, c.Debug)
-	e := Env{s, o, c}
+	e := Env{s: s, o: o, c: c}
+	e.who = &auditClient{Addr: "local", User: os.Getenv("USER")}
+	s.SetMainOutput(o)
 
 	// Daemonize implies server, forbids password.
 	if e.c.Daemonize {
@@ -69,12 +77,33 @@ func main() {
 		}
 		e.c.Server = true
 	}
+	if e.c.BastionBalance != BalanceLeastLoaded && e.c.BastionBalance != BalanceRoundRobin {
+		e.o.ErrExit("--bastionbalance must be %s or %s.\n", BalanceLeastLoaded, BalanceRoundRobin)
+	}
+	switch e.c.IdentityOrder {
+	case IdentityOrderCerts, IdentityOrderKeys, IdentityOrderGiven:
+	default:
+		e.o.ErrExit(
+			"--identityorder must be %s, %s or %s.\n",
+			IdentityOrderCerts,
+			IdentityOrderKeys,
+			IdentityOrderGiven,
+		)
+	}
+	// The SOCKS proxy is only useful if we stick around.
+	if e.c.SocksListen != "" {
+		e.c.Server = true
+	}
+	// The daemonized children fill these in from what the parent opened.
+	if !e.c.Agent {
+		clientPrivateKeys = make([]*os.File, len(e.c.Key.values))
+	}
 	// If we're the parent, let's do some things that may require user input.
 	if godaemon.Stage() == godaemon.StageParent {
-		if !e.c.Agent {
-			clientPrivateKey, err = getPrivateKeyFile(e.c.Key, e)
+		for i := range clientPrivateKeys {
+			clientPrivateKeys[i], err = getPrivateKeyFile(e.c.Key.values[i], e)
 			if err != nil {
-				e.o.ErrExit("Couldn't open SSH private Key: %s\n", err)
+				e.o.ErrExit("Couldn't open SSH private Key %s: %s\n", e.c.Key.values[i], err)
 			}
 		}
 		if e.c.Server {
@@ -90,9 +119,9 @@ func main() {
 		e.o.Mute()
 		// The Daemonize process using this library actually re-runs your
 		// program like three times to set everything up properly. Each time
-		// we re-run ourselves, we inherit these two open file descriptors.
-		if !e.c.Agent {
-			files = append(files, &clientPrivateKey)
+		// we re-run ourselves, we inherit these open file descriptors.
+		for i := range clientPrivateKeys {
+			files = append(files, &clientPrivateKeys[i])
 		}
 		files = append(files, &serverPrivateKey)
 		_, _, err = godaemon.MakeDaemon(&godaemon.DaemonAttr{Files: files})
@@ -101,6 +130,13 @@ func main() {
 			panic(msg)
 		}
 	}
+	// Open the audit log before anything takes a copy of the Env. Not
+	// being able to is no reason not to start.
+	if e.c.AuditLog != "" {
+		if e.a, err = OpenAudit(e.c.AuditLog); err != nil {
+			e.o.Err("Can't open the audit log, not auditing: %s\n", err)
+		}
+	}
 	if e.c.Password {
 		var pw []byte
 		e.o.Out("Password to use for auth: ")
@@ -113,15 +149,29 @@ func main() {
 	}
 	handleSignals(e)
 	if e.c.Agent {
-		sshClientConfig, err = getSSHConfigAgent(e)
+		sshClientConfig, ids, err = getSSHConfigAgent(e)
 	} else {
-		sshClientConfig, err = getSSHConfigFile(clientPrivateKey, e)
+		sshClientConfig, ids, err = getSSHConfigFile(clientPrivateKeys, e)
 	}
 	if err != nil {
 		e.o.ErrExit("Can't load SSH client config: %s\n", err)
 	}
 	sshClientConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
 	e.s.SetSSHConfig(sshClientConfig)
+	e.s.SetIdentities(ids)
+	if e.c.SSHConfig != "" {
+		oc, err := LoadOpenSSHConfig(e.c.SSHConfig, e)
+		if err != nil {
+			e.o.ErrExit("Can't read %s: %s\n", e.c.SSHConfig, err)
+		}
+		e.s.SetOpenSSHConfig(oc)
+	}
+	restored := 0
+	if e.c.Restore {
+		if restored, err = restoreState(e, e.c.StateFile); err != nil {
+			e.o.ErrExit("Can't restore %s: %s\n", e.c.StateFile, err)
+		}
+	}
 	count := 0
 	if e.c.File != "" {
 		e.o.Debug("Reading JSON.\n")
@@ -130,11 +180,21 @@ func main() {
 			e.o.ErrExit("Can't read the JSON data: %s\n", err)
 		}
 	}
-	if count > 0 {
-		e.o.Debug("Connecting to %d hosts.\n", count)
+	if count > 0 || (restored > 0 && !e.c.Server) {
+		e.o.Debug("Connecting to %d hosts.\n", count+restored)
 		startTime := time.Now()
-		connectEverywhere(e, e.c.Timeout)
+		connectEverywhere(e, e.s.GetHostKeys(), e.c.Timeout, noRetries)
 		e.o.Debug("Done in %.2fs.\n", time.Since(startTime).Seconds())
+	} else if restored > 0 {
+		// No need to wait for all of them before taking commands.
+		e.o.Debug("Reconnecting to %d hosts in the background.\n", restored)
+		go connectEverywhere(e, e.s.GetHostKeys(), e.c.Timeout, noRetries)
+	}
+	if e.c.SocksListen != "" {
+		go serveSocks(e)
+	}
+	if e.c.MetricsListen != "" {
+		go serveMetrics(e)
 	}
 	if e.c.Server {
 		s, err := NewSSHServer(serverPrivateKey, e)
@@ -143,6 +203,6 @@ func main() {
 		}
 		s.Start()
 	} else {
-		printSummary(e, e.c.Verbose)
+		printSummary(e, e.s.GetHostKeys(), e.c.Verbose)
 	}
 }
@@ -0,0 +1,268 @@
+/*
+ * metaagent.go
+ *
+ * Forwarding your own ssh-agent to a host hands every key you have to anyone
+ * who owns that host for as long as you're logged in. When you ask for agent
+ * forwarding through one of our ControlMaster sockets, you get our agent
+ * instead. It only has the keys put in it with agent-add, and each of those
+ * can be limited to some hosts, made to expire, or made to ask before every
+ * use. A host only ever sees the keys it's allowed to use, and can't add or
+ * remove any.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	errAgentReadOnly = errors.New("agent: this agent is read only")
+	errAgentNoKey    = errors.New("agent: key not found")
+	errAgentDenied   = errors.New("agent: use of key not confirmed")
+)
+
+// An agentKey is a key in our agent, along with the limits on its use.
+type agentKey struct {
+	signer  ssh.Signer
+	comment string
+	confirm bool      // Ask with SSH_ASKPASS before every use
+	expires time.Time // Zero means never
+	hosts   []string  // Patterns of hosts it may be used on, empty means all
+}
+
+func (ak *agentKey) expired() bool {
+	return !ak.expires.IsZero() && time.Now().After(ak.expires)
+}
+
+// The allowed method tells us if the key may be used on host.
+func (ak *agentKey) allowed(host string) bool {
+	if ak.expired() {
+		return false
+	}
+	if len(ak.hosts) == 0 {
+		return true
+	}
+	name, _ := splitLink(host)
+	return matchHost(ak.hosts, name)
+}
+
+// MetaAgent is the keyring behind the agent we serve to forwarded sessions.
+type MetaAgent struct {
+	mu   sync.Mutex
+	keys []*agentKey
+}
+
+// NewMetaAgent returns an empty MetaAgent.
+func NewMetaAgent() *MetaAgent {
+	return new(MetaAgent)
+}
+
+// The add method puts a key in the agent, replacing it if it's already
+// there. A lifetime of zero never expires.
+func (ma *MetaAgent) add(ak *agentKey, lifetime time.Duration) {
+	if lifetime > 0 {
+		ak.expires = time.Now().Add(lifetime)
+	}
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.prune()
+	fp := ssh.FingerprintSHA256(ak.signer.PublicKey())
+	for i := range ma.keys {
+		if ssh.FingerprintSHA256(ma.keys[i].signer.PublicKey()) == fp {
+			ma.keys[i] = ak
+			return
+		}
+	}
+	ma.keys = append(ma.keys, ak)
+}
+
+// The remove method takes the key with the given fingerprint out of the
+// agent.
+func (ma *MetaAgent) remove(fp string) error {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	for i := range ma.keys {
+		if ssh.FingerprintSHA256(ma.keys[i].signer.PublicKey()) == fp {
+			ma.keys = append(ma.keys[:i], ma.keys[i+1:]...)
+			return nil
+		}
+	}
+	return errAgentNoKey
+}
+
+// The list method returns a copy of the keys in the agent.
+func (ma *MetaAgent) list() []agentKey {
+	ma.mu.Lock()
+	defer ma.mu.Unlock()
+	ma.prune()
+	keys := make([]agentKey, len(ma.keys))
+	for i := range ma.keys {
+		keys[i] = *ma.keys[i]
+	}
+	return keys
+}
+
+// Call with ma.mu held.
+func (ma *MetaAgent) prune() {
+	keys := ma.keys[:0]
+	for i := range ma.keys {
+		if !ma.keys[i].expired() {
+			keys = append(keys, ma.keys[i])
+		}
+	}
+	ma.keys = keys
+}
+
+// The forHost method returns the agent a session on host gets to see.
+func (ma *MetaAgent) forHost(host string, e Env) agent.ExtendedAgent {
+	return &hostAgent{ma, host, e}
+}
+
+// A hostAgent is the MetaAgent as seen from one host.
+type hostAgent struct {
+	ma   *MetaAgent
+	host string
+	e    Env
+}
+
+// The find method looks up a key the host is allowed to use.
+func (ha *hostAgent) find(key ssh.PublicKey) (agentKey, error) {
+	want := key.Marshal()
+	keys := ha.ma.list()
+	for i := range keys {
+		if bytes.Equal(keys[i].signer.PublicKey().Marshal(), want) && keys[i].allowed(ha.host) {
+			return keys[i], nil
+		}
+	}
+	return agentKey{}, errAgentNoKey
+}
+
+func (ha *hostAgent) List() ([]*agent.Key, error) {
+	var list []*agent.Key
+	keys := ha.ma.list()
+	for i := range keys {
+		if !keys[i].allowed(ha.host) {
+			continue
+		}
+		pub := keys[i].signer.PublicKey()
+		list = append(list, &agent.Key{
+			Format:  pub.Type(),
+			Blob:    pub.Marshal(),
+			Comment: keys[i].comment,
+		})
+	}
+	return list, nil
+}
+
+func (ha *hostAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return ha.SignWithFlags(key, data, 0)
+}
+
+func (ha *hostAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	ak, err := ha.find(key)
+	entry := auditEntry{
+		Event:   auditAgentSign,
+		Targets: []string{ha.host},
+		Key:     ssh.FingerprintSHA256(key),
+	}
+	defer func() {
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		audit(ha.e, entry)
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if ak.confirm && !confirmUse(ha.e, ak.comment, ha.host) {
+		err = errAgentDenied
+		return nil, err
+	}
+	var sig *ssh.Signature
+	algorithm := ""
+	switch {
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		algorithm = ssh.KeyAlgoRSASHA256
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		algorithm = ssh.KeyAlgoRSASHA512
+	}
+	if as, ok := ak.signer.(ssh.AlgorithmSigner); ok && algorithm != "" {
+		sig, err = as.SignWithAlgorithm(rand.Reader, data, algorithm)
+	} else {
+		sig, err = ak.signer.Sign(rand.Reader, data)
+	}
+	return sig, err
+}
+
+// The hosts we forward to don't get to change what's in the agent.
+
+func (ha *hostAgent) Add(key agent.AddedKey) error {
+	return errAgentReadOnly
+}
+
+func (ha *hostAgent) Remove(key ssh.PublicKey) error {
+	return errAgentReadOnly
+}
+
+func (ha *hostAgent) RemoveAll() error {
+	return errAgentReadOnly
+}
+
+func (ha *hostAgent) Lock(passphrase []byte) error {
+	return errAgentReadOnly
+}
+
+func (ha *hostAgent) Unlock(passphrase []byte) error {
+	return errAgentReadOnly
+}
+
+func (ha *hostAgent) Signers() ([]ssh.Signer, error) {
+	return nil, errAgentReadOnly
+}
+
+func (ha *hostAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// The confirmUse function asks the user if a key may be used, the same way
+// ssh-agent does, by running SSH_ASKPASS. Without one we can't ask, so the
+// answer is no.
+func confirmUse(e Env, comment, host string) bool {
+	askpass := os.Getenv("SSH_ASKPASS")
+	if askpass == "" {
+		e.o.Debug("No SSH_ASKPASS to confirm use of %s on %s.\n", comment, host)
+		return false
+	}
+	prompt := "Allow use of key " + comment + " on " + host + "?"
+	cmd := exec.Command(askpass, prompt)
+	cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+	if err := cmd.Run(); err != nil {
+		e.o.Debug("%s: %s\n", askpass, err)
+		return false
+	}
+	return true
+}
+
+// The parseAgentHosts function splits a comma separated list of host
+// patterns.
+func parseAgentHosts(list string) []string {
+	var hosts []string
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,217 @@
+/*
+ * metrics.go
+ *
+ * When we run as a daemon it's nice to be able to see how we're doing without
+ * logging in. With --metrics-listen we serve /metrics in the Prometheus text
+ * format. The counters and histograms are kept up to date by the State
+ * serializer as connect and run results and lost connections come in, and
+ * the gauges are read from State whenever somebody scrapes us.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The histogram buckets, in seconds, for connect and run durations.
+var durationBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// The waiter states we always report, even when nobody is in them.
+var connWaitStates = []string{stateDialing, stateEstablishing, stateNewClient, stateDone}
+var runWaitStates = []string{stateNewSession, stateStartSession, stateRunning, stateDone}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() histogram {
+	return histogram{counts: make([]uint64, len(durationBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	secs := d.Seconds()
+	for i := range durationBuckets {
+		if secs <= durationBuckets[i] {
+			h.counts[i]++
+		}
+	}
+	h.sum += secs
+	h.count++
+}
+
+func (h histogram) copy() histogram {
+	c := h
+	c.counts = append([]uint64(nil), h.counts...)
+	return c
+}
+
+// Metrics holds the counters and histograms that the State serializer feeds,
+// plus the gauges it fills in when asked for a copy.
+type Metrics struct {
+	connects      map[string]uint64 // By result, "ok" or an error class
+	runs          map[string]uint64
+	losses        map[string]uint64 // By error class
+	connectTimes  histogram
+	runTimes      histogram
+	targets       int
+	connectedHost int
+	proxies       int
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		connects:     make(map[string]uint64),
+		runs:         make(map[string]uint64),
+		losses:       make(map[string]uint64),
+		connectTimes: newHistogram(),
+		runTimes:     newHistogram(),
+	}
+}
+
+func (m *Metrics) observeConnect(ok bool, d time.Duration, err error) {
+	m.connects[metricResult(ok, err)]++
+	if d > 0 {
+		m.connectTimes.observe(d)
+	}
+}
+
+func (m *Metrics) observeRun(ok bool, d time.Duration, err error) {
+	m.runs[metricResult(ok, err)]++
+	if d > 0 {
+		m.runTimes.observe(d)
+	}
+}
+
+// A connection that was up and went away isn't a failed connect, so it gets
+// counted on its own.
+func (m *Metrics) observeLost(err error) {
+	m.losses[metricResult(false, err)]++
+}
+
+func (m *Metrics) copy() Metrics {
+	c := *m
+	c.connects = make(map[string]uint64, len(m.connects))
+	for k, v := range m.connects {
+		c.connects[k] = v
+	}
+	c.runs = make(map[string]uint64, len(m.runs))
+	for k, v := range m.runs {
+		c.runs[k] = v
+	}
+	c.losses = make(map[string]uint64, len(m.losses))
+	for k, v := range m.losses {
+		c.losses[k] = v
+	}
+	c.connectTimes = m.connectTimes.copy()
+	c.runTimes = m.runTimes.copy()
+	return c
+}
+
+func metricResult(ok bool, err error) string {
+	if ok {
+		return "ok"
+	}
+	if err == nil {
+		return UnknownError
+	}
+	return errorClass(err)
+}
+
+// The serveMetrics function serves /metrics on the --metrics-listen address.
+func serveMetrics(e Env) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, e)
+	})
+	e.o.Debug("Serving metrics on %s\n", e.c.MetricsListen)
+	if err := http.ListenAndServe(e.c.MetricsListen, mux); err != nil {
+		e.o.ErrExit("Failed to serve metrics on %s: %s\n", e.c.MetricsListen, err)
+	}
+}
+
+func writeMetrics(w io.Writer, e Env) {
+	m := e.s.GetMetrics()
+	wi := e.s.GetWaiterInfo()
+
+	gauge(w, "metassh_targets", "Number of targeted hosts.")
+	fmt.Fprintf(w, "metassh_targets %d\n", m.targets)
+	gauge(w, "metassh_connected_hosts", "Number of targeted hosts with an SSH connection.")
+	fmt.Fprintf(w, "metassh_connected_hosts %d\n", m.connectedHost)
+	gauge(w, "metassh_connected_proxies", "Number of connected bastions.")
+	fmt.Fprintf(w, "metassh_connected_proxies %d\n", m.proxies)
+
+	gauge(w, "metassh_conn_waiters", "In-flight connections by state.")
+	for _, state := range labelKeys(connWaitStates, wi.connStates) {
+		fmt.Fprintf(w, "metassh_conn_waiters{state=%q} %d\n", state, wi.connStates[state])
+	}
+	gauge(w, "metassh_conn_wait_seconds", "Average time in-flight connections have been waiting.")
+	fmt.Fprintf(w, "metassh_conn_wait_seconds %g\n", wi.avgConnWait.Seconds())
+	gauge(w, "metassh_run_waiters", "In-flight runs by state.")
+	for _, state := range labelKeys(runWaitStates, wi.runStates) {
+		fmt.Fprintf(w, "metassh_run_waiters{state=%q} %d\n", state, wi.runStates[state])
+	}
+	gauge(w, "metassh_run_wait_seconds", "Average time in-flight runs have been waiting.")
+	fmt.Fprintf(w, "metassh_run_wait_seconds %g\n", wi.avgRunWait.Seconds())
+
+	counter(w, "metassh_connects_total", "Connection attempts by result.", "result", m.connects)
+	counter(w, "metassh_runs_total", "Command runs by result.", "result", m.runs)
+	counter(w, "metassh_connections_lost_total", "Established connections lost, by error class.", "error", m.losses)
+
+	writeHistogram(w, "metassh_connect_duration_seconds", "How long connecting took.", m.connectTimes)
+	writeHistogram(w, "metassh_run_duration_seconds", "How long runs took.", m.runTimes)
+}
+
+func gauge(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+func counter(w io.Writer, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	results := make([]string, 0, len(values))
+	for k := range values {
+		results = append(results, k)
+	}
+	sort.Strings(results)
+	for i := range results {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, results[i], values[results[i]])
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, h histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i := range durationBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, durationBuckets[i], h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// The labelKeys function returns the known states plus whatever else showed
+// up, so a state doesn't vanish from the graphs just because it's empty.
+func labelKeys(known []string, seen map[string]int) []string {
+	keys := append([]string(nil), known...)
+	var extra []string
+	for k := range seen {
+		found := false
+		for i := range known {
+			if known[i] == k {
+				found = true
+			}
+		}
+		if !found {
+			extra = append(extra, k)
+		}
+	}
+	sort.Strings(extra)
+	return append(keys, extra...)
+}
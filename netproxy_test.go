@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A fakeSOCKS5 is just enough of a SOCKS5 server to test the dialer against.
+type fakeSOCKS5 struct {
+	method byte   // The auth method it picks
+	user   string // What it wants for socks5AuthPassword
+	pass   string
+	reply  byte        // What it says to the CONNECT
+	got    chan string // The address it was asked for
+}
+
+func (f *fakeSOCKS5) serve(conn net.Conn) {
+	defer conn.Close()
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, hdr[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{socks5Version, f.method})
+	switch f.method {
+	case socks5AuthNoAccept:
+		return
+	case socks5AuthPassword:
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != f.user || string(pass) != f.pass {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	f.got <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	// Bind to a domain name, to make sure the dialer skips it properly.
+	resp := []byte{socks5Version, f.reply, 0x00, socks5AddrDomain, 5}
+	resp = append(resp, "bound"...)
+	resp = append(resp, 0x00, 0x16)
+	conn.Write(resp)
+	if f.reply == 0x00 {
+		io.Copy(conn, conn)
+	}
+}
+
+// The listen function runs serve for each connection to a new local
+// listener, and returns its address.
+func listen(t *testing.T, serve func(net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// The echoes function checks that what we write down conn comes back.
+func echoes(t *testing.T, conn net.Conn) {
+	t.Helper()
+	msg := []byte("SSH-2.0-Test\r\n")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(msg) {
+		t.Errorf("tunnel gave back %q, want %q", buf, msg)
+	}
+}
+
+func TestSOCKS5Dial(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  fakeSOCKS5
+		creds   string
+		addr    string
+		wantErr string
+	}{
+		{"no auth, domain", fakeSOCKS5{method: socks5AuthNone}, "", "db-1.example.com:22", ""},
+		{"no auth, ipv4", fakeSOCKS5{method: socks5AuthNone}, "", "10.1.2.3:2222", ""},
+		{"no auth, ipv6", fakeSOCKS5{method: socks5AuthNone}, "", "[fd00::1]:22", ""},
+		{
+			"password",
+			fakeSOCKS5{method: socks5AuthPassword, user: "alice", pass: "s3cret"},
+			"alice:s3cret@", "db-1:22", "",
+		},
+		{
+			"wrong password",
+			fakeSOCKS5{method: socks5AuthPassword, user: "alice", pass: "s3cret"},
+			"alice:guess@", "db-1:22", "proxy authentication failed",
+		},
+		{
+			"password wanted, none given",
+			fakeSOCKS5{method: socks5AuthPassword, user: "alice", pass: "s3cret"},
+			"", "db-1:22", "proxy wants a password",
+		},
+		{
+			"no acceptable methods",
+			fakeSOCKS5{method: socks5AuthNoAccept},
+			"", "db-1:22", "no acceptable authentication methods",
+		},
+		{
+			"connection refused",
+			fakeSOCKS5{method: socks5AuthNone, reply: 0x05},
+			"", "db-1:22", "connection refused",
+		},
+		{
+			"unknown reply",
+			fakeSOCKS5{method: socks5AuthNone, reply: 0x42},
+			"", "db-1:22", "unknown error 66",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tt.server
+			f.got = make(chan string, 1)
+			proxy := listen(t, func(conn net.Conn) { f.serve(conn) })
+			dial, err := netProxyDialer("socks5://" + tt.creds + proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dial("tcp", tt.addr, 5*time.Second)
+			if tt.wantErr != "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("got no error, want %q", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := <-f.got; got != tt.addr {
+				t.Errorf("proxy was asked for %s, want %s", got, tt.addr)
+			}
+			echoes(t, conn)
+		})
+	}
+}
+
+// The fakeHTTPProxy function returns something that answers a CONNECT for
+// addr, as long as the credentials match auth, with a 407 if not. On success, it
+// sends early before the tunnel echoes, as a real server might.
+func fakeHTTPProxy(addr, auth, early string) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		switch {
+		case req.Method != "CONNECT" || req.Host != addr:
+			io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\n\r\n")
+			return
+		case auth != "" && req.Header.Get("Proxy-Authorization") !=
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(auth)):
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"+early)
+		io.Copy(conn, br)
+	}
+}
+
+func TestHTTPConnectDial(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    string
+		creds   string
+		addr    string
+		wantErr string
+	}{
+		{"no auth", "", "", "db-1:22", ""},
+		{"password", "alice:s3cret", "alice:s3cret@", "db-1:22", ""},
+		{"wrong password", "alice:s3cret", "alice:guess@", "db-1:22", "407"},
+		{"no password", "alice:s3cret", "", "db-1:22", "407"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			early := "SSH-2.0-Early\r\n"
+			proxy := listen(t, fakeHTTPProxy(tt.addr, tt.auth, early))
+			dial, err := netProxyDialer("http://" + tt.creds + proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dial("tcp", tt.addr, 5*time.Second)
+			if tt.wantErr != "" {
+				if err == nil {
+					conn.Close()
+					t.Fatalf("got no error, want %q", tt.wantErr)
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %q, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// Whatever came in with the response has to be read first.
+			buf := make([]byte, len(early))
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != early {
+				t.Errorf("got %q first, want %q", buf, early)
+			}
+			echoes(t, conn)
+		})
+	}
+}
+
+func TestNetProxyDialer(t *testing.T) {
+	tests := []struct {
+		link    string
+		wantErr string
+	}{
+		{"socks5://proxy:1080", ""},
+		{"http://proxy:3128", ""},
+		{"socks5://", "has no host"},
+		{"ftp://proxy:21", "Unsupported proxy scheme"},
+	}
+	for _, tt := range tests {
+		_, err := netProxyDialer(tt.link)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %s", tt.link, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: got %v, want %q", tt.link, err, tt.wantErr)
+		}
+	}
+	// Nothing listening.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+	for _, scheme := range []string{"socks5", "http"} {
+		dial, _ := netProxyDialer(scheme + "://" + closed)
+		if conn, err := dial("tcp", "db-1:22", 5*time.Second); err == nil {
+			conn.Close()
+			t.Errorf("%s: dialing a closed port worked", scheme)
+		}
+	}
+}
+
+func TestNetProxyTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	// A proxy that takes the connection and then never says a word.
+	silent := listen(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	})
+	socks := &fakeSOCKS5{method: socks5AuthNone, got: make(chan string, 1)}
+	working := map[string]string{
+		"socks5": listen(t, func(conn net.Conn) { socks.serve(conn) }),
+		"http":   listen(t, fakeHTTPProxy("db-1:22", "", "")),
+	}
+	for _, scheme := range []string{"socks5", "http"} {
+		dial, err := netProxyDialer(scheme + "://" + silent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if conn, err := dial("tcp", "db-1:22", timeout); err == nil {
+			conn.Close()
+			t.Errorf("%s: a silent proxy got us through", scheme)
+		}
+		if took := time.Since(start); took > 10*timeout {
+			t.Errorf("%s: a silent proxy held us up for %s", scheme, took)
+		}
+
+		// Once we're through, the deadline is off, and the tunnel is
+		// good for as long as SSH wants it.
+		dial, err = netProxyDialer(scheme + "://" + working[scheme])
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dial("tcp", "db-1:22", timeout)
+		if err != nil {
+			t.Fatalf("%s: %s", scheme, err)
+		}
+		time.Sleep(2 * timeout)
+		echoes(t, conn)
+		conn.Close()
+	}
+}
@@ -0,0 +1,515 @@
+/*
+ * openssh.go
+ *
+ * This file contains a reader for the user's OpenSSH client configuration
+ * (~/.ssh/config). We only care about a handful of keywords: HostName, User,
+ * Port, IdentityFile, ProxyJump and ProxyCommand. ProxyJump hops get turned
+ * into the chain for a target, and a ProxyCommand gets run as a local
+ * subprocess whose STDIN/STDOUT is used as the connection to the host.
+ *
+ * Like OpenSSH, the first value obtained for a keyword wins, so the more
+ * specific Host blocks should come first. That goes for ProxyJump and
+ * ProxyCommand too, whichever of the two comes first is the one used. An
+ * Include inside a Host block only applies to the hosts that block does.
+ * Match blocks are skipped.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MaxJumpDepth limits how deep we'll follow ProxyJump hosts that have their
+// own ProxyJump.
+const MaxJumpDepth = 8
+
+// OpenSSHConfig holds the parsed Host blocks from an OpenSSH client config
+// along with the signers for any unencrypted IdentityFiles it mentions.
+type OpenSSHConfig struct {
+	blocks     []sshConfigBlock
+	identities map[string]ssh.Signer
+}
+
+type sshConfigBlock struct {
+	patterns []string
+	within   [][]string // The patterns of the blocks we were included from
+	options  []sshConfigOption
+}
+
+type sshConfigOption struct {
+	keyword string
+	value   string
+}
+
+// sshHostConfig contains the settings that apply to a particular host.
+type sshHostConfig struct {
+	hostName      string
+	user          string
+	port          string
+	identityFiles []string
+	proxyJump     string
+	proxyCommand  string
+}
+
+// LoadOpenSSHConfig reads and parses an OpenSSH client config file. A file
+// that doesn't exist is not an error, you just get an empty config.
+func LoadOpenSSHConfig(fileName string, e Env) (*OpenSSHConfig, error) {
+	oc := &OpenSSHConfig{identities: make(map[string]ssh.Signer)}
+	if err := oc.parseFile(fileName, 0, nil); err != nil {
+		if os.IsNotExist(err) {
+			return oc, nil
+		}
+		return nil, err
+	}
+	oc.loadIdentities(e)
+	return oc, nil
+}
+
+func (oc *OpenSSHConfig) parseFile(fileName string, depth int, within [][]string) error {
+	if depth > MaxJumpDepth {
+		return errors.New("Too many nested Include directives.")
+	}
+	fp, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return oc.parse(fp, depth, within)
+}
+
+// The parse method reads a config into blocks. Everything in it only
+// applies to hosts that also match the patterns in within, which is how an
+// Include inside a Host block is scoped to that block.
+func (oc *OpenSSHConfig) parse(r io.Reader, depth int, within [][]string) error {
+	// Options before the first Host line apply to every host.
+	cur := &sshConfigBlock{patterns: []string{"*"}, within: within}
+	skipping := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		keyword, args := splitConfigLine(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+		switch keyword {
+		case "host":
+			oc.blocks = append(oc.blocks, *cur)
+			cur = &sshConfigBlock{patterns: args, within: within}
+			skipping = false
+		case "match":
+			// We don't do Match, so ignore everything up to the next
+			// Host or Match line.
+			skipping = true
+		case "include":
+			if skipping {
+				continue
+			}
+			oc.blocks = append(oc.blocks, *cur)
+			inner := append(append([][]string(nil), within...), cur.patterns)
+			for i := range args {
+				if err := oc.include(args[i], depth, inner); err != nil {
+					return err
+				}
+			}
+			cur = &sshConfigBlock{patterns: cur.patterns, within: within}
+		default:
+			if skipping || len(args) == 0 {
+				continue
+			}
+			cur.options = append(cur.options, sshConfigOption{
+				keyword: keyword,
+				value:   strings.Join(args, " "),
+			})
+		}
+	}
+	oc.blocks = append(oc.blocks, *cur)
+	return scanner.Err()
+}
+
+// Relative Include paths are relative to ~/.ssh, and may be globs.
+func (oc *OpenSSHConfig) include(pattern string, depth int, within [][]string) error {
+	pattern = expandTilde(pattern)
+	if !path.IsAbs(pattern) {
+		pattern = os.Getenv("HOME") + "/.ssh/" + pattern
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for i := range files {
+		if err := oc.parseFile(files[i], depth+1, within); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The splitConfigLine function breaks a config line into a lower-cased keyword
+// and its arguments. Keywords and arguments can be separated by whitespace or
+// an equals sign, and arguments can be double quoted.
+func splitConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+	var args []string
+	var arg []byte
+	inQuote := false
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+		case (c == ' ' || c == '\t') && !inQuote:
+			if len(arg) > 0 {
+				args = append(args, string(arg))
+				arg = nil
+			}
+		default:
+			arg = append(arg, c)
+		}
+	}
+	if len(arg) > 0 {
+		args = append(args, string(arg))
+	}
+	return keyword, args
+}
+
+// The matchHost function returns true if the host matches the patterns of a
+// Host line. A negated pattern that matches wins over everything else.
+func matchHost(patterns []string, host string) bool {
+	matched := false
+	for i := range patterns {
+		pattern := patterns[i]
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		ok, err := path.Match(pattern, host)
+		if err != nil || !ok {
+			continue
+		}
+		if negate {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// The matches method returns true if the block applies to host.
+func (block sshConfigBlock) matches(host string) bool {
+	for i := range block.within {
+		if !matchHost(block.within[i], host) {
+			return false
+		}
+	}
+	return matchHost(block.patterns, host)
+}
+
+// Lookup returns the settings for a host. Any port in the link is ignored for
+// matching purposes. It's safe to call on a nil config, in which case there
+// are no settings.
+func (oc *OpenSSHConfig) Lookup(link string) sshHostConfig {
+	var hc sshHostConfig
+	if oc == nil {
+		return hc
+	}
+	host, _ := splitLink(link)
+	// ProxyJump and ProxyCommand are mutually exclusive, and whichever we
+	// see first wins, even if it's none.
+	proxied := false
+	for i := range oc.blocks {
+		block := oc.blocks[i]
+		if !block.matches(host) {
+			continue
+		}
+		for j := range block.options {
+			opt := block.options[j]
+			switch opt.keyword {
+			case "hostname":
+				if hc.hostName == "" {
+					hc.hostName = strings.Replace(opt.value, "%h", host, -1)
+				}
+			case "user":
+				if hc.user == "" {
+					hc.user = opt.value
+				}
+			case "port":
+				if hc.port == "" {
+					hc.port = opt.value
+				}
+			case "identityfile":
+				hc.identityFiles = append(hc.identityFiles, expandTilde(opt.value))
+			case "proxyjump":
+				if !proxied {
+					hc.proxyJump = opt.value
+					proxied = true
+				}
+			case "proxycommand":
+				if !proxied {
+					hc.proxyCommand = opt.value
+					proxied = true
+				}
+			}
+		}
+	}
+	if hc.proxyJump == "none" {
+		hc.proxyJump = ""
+	}
+	if hc.proxyCommand == "none" {
+		hc.proxyCommand = ""
+	}
+	return hc
+}
+
+// Chain figures out the chain for a host by following its ProxyJump hops,
+// and any ProxyJump hops that those hosts have in turn.
+func (oc *OpenSSHConfig) Chain(host string) []string {
+	return oc.chain(host, 0)
+}
+
+func (oc *OpenSSHConfig) chain(host string, depth int) []string {
+	hc := oc.Lookup(host)
+	if hc.proxyJump == "" || depth > MaxJumpDepth {
+		return []string{host}
+	}
+	var chain []string
+	jumps := strings.Split(hc.proxyJump, ",")
+	for i := range jumps {
+		// A user@ stays in the link, and beats the jump host's own config.
+		jump := strings.TrimSpace(jumps[i])
+		if _, hop := linkUser(jump); hop == "" {
+			continue
+		}
+		if i == 0 {
+			// Only the first hop can have hops of its own.
+			chain = append(chain, oc.chain(jump, depth+1)...)
+		} else {
+			chain = append(chain, jump)
+		}
+	}
+	return append(chain, host)
+}
+
+// The address method returns the address to dial for a link. A port in the
+// link itself beats the Port from the config, and we default to SSHPort.
+func (hc sshHostConfig) address(link string) string {
+	host, port := hc.hostPort(link)
+	return net.JoinHostPort(host, port)
+}
+
+func (hc sshHostConfig) hostPort(link string) (string, string) {
+	host, port := splitLink(link)
+	if hc.hostName != "" {
+		host = hc.hostName
+	}
+	if port == "" {
+		port = hc.port
+	}
+	if port == "" {
+		port = SSHPort
+	}
+	return host, port
+}
+
+// The apply method adjusts a client config with the User and IdentityFiles
+// for a host. Identities are tried before the global ones. The SSH library
+// only ever tries the first publickey auth method, so they have to go in the
+// same one as the global identities, ids, rather than a method of their own.
+// It returns the log of what gets offered when the config is used.
+func (hc sshHostConfig) apply(cfg *ssh.ClientConfig, oc *OpenSSHConfig, ids identitySource) *offerLog {
+	if hc.user != "" {
+		cfg.User = hc.user
+	}
+	ol := newOfferLog(oc, ids)
+	var signers []ssh.Signer
+	for i := range hc.identityFiles {
+		if signer, exists := oc.identities[hc.identityFiles[i]]; exists {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) == 0 && ids == nil {
+		return ol
+	}
+	auth := []ssh.AuthMethod{ssh.PublicKeysCallback(ol.wrap(func() ([]ssh.Signer, error) {
+		if ids == nil {
+			return signers, nil
+		}
+		global, err := ids.Signers()
+		return append(append([]ssh.Signer(nil), signers...), global...), err
+	}))}
+	// Our own publickey method is always first, see getSSHConfigFile.
+	if ids != nil && len(cfg.Auth) > 0 {
+		cfg.Auth = append(auth, cfg.Auth[1:]...)
+	} else {
+		cfg.Auth = append(auth, cfg.Auth...)
+	}
+	return ol
+}
+
+// We can't prompt for passphrases for every key in the config, so only
+// unencrypted identities get loaded. Hosts that need an encrypted key will
+// have to make do with the global --key or the agent.
+func (oc *OpenSSHConfig) loadIdentities(e Env) {
+	for i := range oc.blocks {
+		for j := range oc.blocks[i].options {
+			opt := oc.blocks[i].options[j]
+			if opt.keyword != "identityfile" {
+				continue
+			}
+			name := expandTilde(opt.value)
+			if _, exists := oc.identities[name]; exists {
+				continue
+			}
+			buf, err := ioutil.ReadFile(name)
+			if err != nil {
+				e.o.Debug("IdentityFile %s: %s\n", name, err)
+				continue
+			}
+			signer, err := ssh.ParsePrivateKey(buf)
+			if err != nil {
+				e.o.Debug("IdentityFile %s: %s\n", name, err)
+				continue
+			}
+			oc.identities[name] = signer
+		}
+	}
+}
+
+func expandTilde(name string) string {
+	if strings.HasPrefix(name, "~/") {
+		return os.Getenv("HOME") + name[1:]
+	}
+	return name
+}
+
+// The expand method fills in the %h, %p, %r and %n tokens of a ProxyCommand.
+func (hc sshHostConfig) expand(cmd, link, user string) string {
+	host, port := hc.hostPort(link)
+	alias, _ := splitLink(link)
+	if hc.user != "" {
+		user = hc.user
+	}
+	r := strings.NewReplacer(
+		"%%", "%",
+		"%h", host,
+		"%p", port,
+		"%r", user,
+		"%n", alias,
+	)
+	return r.Replace(cmd)
+}
+
+// cmdConn is a net.Conn that talks to the STDIN and STDOUT of a ProxyCommand.
+type cmdConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	name   string
+}
+
+type cmdAddr struct {
+	name string
+}
+
+func (a cmdAddr) Network() string { return "proxycommand" }
+func (a cmdAddr) String() string  { return a.name }
+
+// The dialProxyCommand function runs a ProxyCommand through the shell and
+// returns a net.Conn hooked up to it. Its STDERR goes to ours, like OpenSSH.
+func dialProxyCommand(command string) (net.Conn, error) {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdConn{cmd, stdin, stdout, command}, nil
+}
+
+func (c *cmdConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *cmdConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+// Close hangs up on the ProxyCommand and reaps it.
+func (c *cmdConn) Close() error {
+	err := c.stdin.Close()
+	if c.cmd.Process != nil {
+		if kErr := c.cmd.Process.Kill(); kErr != nil && err == nil {
+			err = kErr
+		}
+	}
+	_ = c.cmd.Wait()
+	return err
+}
+
+func (c *cmdConn) LocalAddr() net.Addr                { return cmdAddr{"local"} }
+func (c *cmdConn) RemoteAddr() net.Addr               { return cmdAddr{c.name} }
+func (c *cmdConn) SetDeadline(t time.Time) error      { return nil }
+func (c *cmdConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *cmdConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// The dialHost function makes a direct SSH connection to a link, honoring
+// any HostName, Port and ProxyCommand the config has for it. If we were
+// handed a dialer for a SOCKS5 or HTTP proxy, we go through that.
+func dialHost(link string, cfg *ssh.ClientConfig, hc sshHostConfig, dial dialFunc) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+
+	addr := hc.address(link)
+	switch {
+	case hc.proxyCommand != "":
+		conn, err = dialProxyCommand(hc.expand(hc.proxyCommand, link, cfg.User))
+		err = stageError(stageDial, err)
+	case dial != nil:
+		conn, err = dial("tcp", addr, cfg.Timeout)
+		err = stageError(stageNetProxy, err)
+	default:
+		// This is what ssh.Dial does, but we want to know which half
+		// of it failed.
+		conn, err = net.DialTimeout("tcp", addr, cfg.Timeout)
+		err = stageError(stageDial, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		if cErr := conn.Close(); cErr != nil {
+			err = fmt.Errorf("%s (and close failed: %s)", err, cErr)
+		}
+		return nil, stageError(stageHandshake, err)
+	}
+	return ssh.NewClient(ncc, chans, reqs), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parseTestConfig(t *testing.T, config string) *OpenSSHConfig {
+	t.Helper()
+	oc := new(OpenSSHConfig)
+	if err := oc.parse(strings.NewReader(config), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	return oc
+}
+
+func TestLookupProxyOrder(t *testing.T) {
+	config := `
+Host cmd-first
+	ProxyCommand nc -X connect -x proxy:3128 %h %p
+	ProxyJump bastion
+
+Host jump-first
+	ProxyJump bastion
+	ProxyCommand nc %h %p
+
+Host none-first
+	ProxyJump none
+
+Host cmd-*
+	ProxyJump other
+
+Host *
+	ProxyCommand ssh -W %h:%p fallback
+`
+	oc := parseTestConfig(t, config)
+	tests := []struct {
+		host, jump, cmd string
+	}{
+		{"cmd-first", "", "nc -X connect -x proxy:3128 %h %p"},
+		{"jump-first", "bastion", ""},
+		{"none-first", "", ""},
+		{"cmd-later", "other", ""},
+		{"anything", "", "ssh -W %h:%p fallback"},
+	}
+	for _, tt := range tests {
+		hc := oc.Lookup(tt.host)
+		if hc.proxyJump != tt.jump || hc.proxyCommand != tt.cmd {
+			t.Errorf("%s: got jump %q command %q, want %q %q",
+				tt.host, hc.proxyJump, hc.proxyCommand, tt.jump, tt.cmd)
+		}
+	}
+}
+
+func TestIncludeInheritsBlock(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, config string) string {
+		fileName := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fileName, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+	// No Host line of its own, so it's all for whoever included it.
+	db := write("db.conf", "User dba\nPort 2222\n")
+	// Its own Host lines only count for hosts the includer's do too.
+	nested := write("nested.conf", "Host *-1\n\tUser first\nHost *\n\tUser rest\n")
+	main := write("config", `
+Host db-*
+	Include `+db+`
+	HostName %h.db.example.com
+
+Host web-*
+	Include `+nested+`
+
+Host *
+	User nobody
+	Include `+db+`
+`)
+	oc := new(OpenSSHConfig)
+	if err := oc.parseFile(main, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, hostName, user, port string
+	}{
+		{"db-1", "db-1.db.example.com", "dba", "2222"},
+		{"web-1", "", "first", "2222"},
+		{"web-2", "", "rest", "2222"},
+		// Not in db-* or web-*, so what they include doesn't apply, only
+		// the Host * block, whose User comes before its Include.
+		{"mail-1", "", "nobody", "2222"},
+	}
+	for _, tt := range tests {
+		hc := oc.Lookup(tt.host)
+		if hc.hostName != tt.hostName || hc.user != tt.user || hc.port != tt.port {
+			t.Errorf("%s: got %q %q %q, want %q %q %q", tt.host,
+				hc.hostName, hc.user, hc.port, tt.hostName, tt.user, tt.port)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * percentile.go
+ *
+ * We used to estimate quantiles with a streaming library, which traded
+ * accuracy for memory we don't need to save. We never have more than some
+ * tens of thousands of durations, so this file just sorts them and does the
+ * math exactly, which also means the same data always gives the same answer.
+ *
+ */
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HistogramWidth is how many characters the longest histogram bar gets.
+const HistogramWidth = 50
+
+// samples is a sorted list of durations, in seconds.
+type samples []float64
+
+func newSamples(values []float64) samples {
+	s := append(samples(nil), values...)
+	sort.Float64s(s)
+	return s
+}
+
+func mapValues(m map[string]float64) []float64 {
+	values := make([]float64, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// The percentile method returns the p'th percentile (p between 0 and 1) by
+// linear interpolation between the closest ranks, so percentile(0) is the
+// fastest sample, percentile(1) the slowest, and percentile(0.5) the median.
+func (s samples) percentile(p float64) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	if p <= 0 {
+		return s[0]
+	}
+	if p >= 1 {
+		return s[len(s)-1]
+	}
+	rank := p * float64(len(s)-1)
+	lower := int(rank)
+	frac := rank - float64(lower)
+	if lower+1 >= len(s) {
+		return s[lower]
+	}
+	return s[lower] + frac*(s[lower+1]-s[lower])
+}
+
+// The buckets method counts the samples that fall in each of the buckets
+// bounded by the durationBuckets, with one more for everything slower.
+func (s samples) buckets() []int {
+	counts := make([]int, len(durationBuckets)+1)
+	for i := range s {
+		b := sort.SearchFloat64s(durationBuckets, s[i])
+		counts[b]++
+	}
+	return counts
+}
+
+// The outputHistogram function draws a sideways histogram of the samples,
+// leaving off the empty buckets at either end.
+func outputHistogram(e Env, what string, s samples) {
+	counts := s.buckets()
+	first, last, most := -1, -1, 0
+	for i := range counts {
+		if counts[i] == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+		if counts[i] > most {
+			most = counts[i]
+		}
+	}
+	e.o.Out("%s times (%d samples):\n", what, len(s))
+	if first < 0 {
+		return
+	}
+	for i := first; i <= last; i++ {
+		label := ">" + formatBucket(durationBuckets[len(durationBuckets)-1])
+		if i < len(durationBuckets) {
+			label = "<=" + formatBucket(durationBuckets[i])
+		}
+		bar := counts[i] * HistogramWidth / most
+		if counts[i] > 0 && bar == 0 {
+			bar = 1
+		}
+		e.o.Out("%9s |%-*s %d\n", label, HistogramWidth, strings.Repeat("#", bar), counts[i])
+	}
+}
+
+func formatBucket(b float64) string {
+	return strconv.FormatFloat(b, 'f', -1, 64) + "s"
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestPercentile(t *testing.T) {
+	hundred := make([]float64, 101)
+	for i := range hundred {
+		hundred[i] = float64(100 - i)
+	}
+	tests := []struct {
+		name   string
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{"empty", nil, 0.5, 0},
+		{"empty, 0.01", nil, 0.01, 0},
+		{"single, 0.01", []float64{2.5}, 0.01, 2.5},
+		{"single, 0.5", []float64{2.5}, 0.5, 2.5},
+		{"single, 0.99", []float64{2.5}, 0.99, 2.5},
+		{"two, 0.01", []float64{3, 1}, 0.01, 1.02},
+		{"two, median", []float64{3, 1}, 0.5, 2},
+		{"two, 0.99", []float64{3, 1}, 0.99, 2.98},
+		{"odd median", []float64{5, 1, 3}, 0.5, 3},
+		{"even median", []float64{4, 1, 3, 2}, 0.5, 2.5},
+		{"min", []float64{4, 1, 3, 2}, 0, 1},
+		{"max", []float64{4, 1, 3, 2}, 1, 4},
+		{"below 0", []float64{4, 1, 3, 2}, -1, 1},
+		{"above 1", []float64{4, 1, 3, 2}, 2, 4},
+		{"hundred, 0.01", hundred, 0.01, 1},
+		{"hundred, 0.25", hundred, 0.25, 25},
+		{"hundred, 0.90", hundred, 0.90, 90},
+		{"hundred, 0.99", hundred, 0.99, 99},
+		{"dupes", []float64{1, 1, 1, 1}, 0.01, 1},
+	}
+	for _, tt := range tests {
+		got := newSamples(tt.values).percentile(tt.p)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: percentile(%g) = %g, want %g", tt.name, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestNewSamplesCopies(t *testing.T) {
+	values := []float64{3, 1, 2}
+	newSamples(values)
+	if values[0] != 3 || values[1] != 1 || values[2] != 2 {
+		t.Errorf("newSamples sorted its argument: %v", values)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	last := len(durationBuckets)
+	tests := []struct {
+		name   string
+		values []float64
+		want   map[int]int // Bucket to count, the rest are zero
+	}{
+		{"empty", nil, map[int]int{}},
+		{"single", []float64{0.3}, map[int]int{3: 1}},
+		{"zero", []float64{0}, map[int]int{0: 1}},
+		{"on the bound", []float64{0.05, 0.1, 300}, map[int]int{0: 1, 1: 1, last - 1: 1}},
+		{"just over", []float64{0.0500001}, map[int]int{1: 1}},
+		{"slower than all", []float64{301, 1000}, map[int]int{last: 2}},
+	}
+	for _, tt := range tests {
+		got := newSamples(tt.values).buckets()
+		if len(got) != last+1 {
+			t.Fatalf("%s: got %d buckets, want %d", tt.name, len(got), last+1)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: bucket %d has %d, want %d", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestOutputHistogram(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   []string
+	}{
+		{"empty", nil, []string{"Run times (0 samples):"}},
+		{
+			"single",
+			[]float64{0.3},
+			[]string{
+				"Run times (1 samples):",
+				"   <=0.5s |" + strings.Repeat("#", HistogramWidth) + " 1",
+			},
+		},
+		{
+			"gap",
+			append(make([]float64, 100), 0.2, 0.7),
+			[]string{
+				"Run times (102 samples):",
+				"  <=0.05s |" + strings.Repeat("#", HistogramWidth) + " 100",
+				"   <=0.1s |" + strings.Repeat(" ", HistogramWidth) + " 0",
+				"  <=0.25s |#" + strings.Repeat(" ", HistogramWidth-1) + " 1",
+				"   <=0.5s |" + strings.Repeat(" ", HistogramWidth) + " 0",
+				"     <=1s |#" + strings.Repeat(" ", HistogramWidth-1) + " 1",
+			},
+		},
+		{
+			"slower than all",
+			[]float64{301, 302},
+			[]string{
+				"Run times (2 samples):",
+				"    >300s |" + strings.Repeat("#", HistogramWidth) + " 2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		e := Env{o: NewOutput(&out, &out, false, false)}
+		outputHistogram(e, "Run", newSamples(tt.values))
+		lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+		if strings.Join(lines, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, strings.Join(lines, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestQuantHistogramDefaultsToBoth(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-H"}, []string{"Connect times (0 samples):", "Run times (0 samples):"}},
+		{[]string{"-H", "-r"}, []string{"Run times (0 samples):"}},
+		{[]string{"-H", "-c"}, []string{"Connect times (0 samples):"}},
+	}
+	for _, tt := range tests {
+		e, out := testEnv()
+		if err := quant(e, tt.args); err != nil {
+			t.Errorf("%v: %s", tt.args, err)
+			continue
+		}
+		if got := strings.TrimRight(out.String(), "\n"); got != strings.Join(tt.want, "\n") {
+			t.Errorf("%v: got\n%s\nwant\n%s", tt.args, got, strings.Join(tt.want, "\n"))
+		}
+	}
+	e, _ := testEnv()
+	if err := quant(e, []string{"0.95", "0.99"}); err == nil {
+		t.Error("quant without -r, -c or -H worked")
+	}
+}
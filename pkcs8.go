@@ -0,0 +1,126 @@
+/*
+ * pkcs8.go
+ *
+ * The SSH library can decrypt the old style OpenSSL PEM keys and OpenSSH's
+ * own format, but not encrypted PKCS#8 ("BEGIN ENCRYPTED PRIVATE KEY"), which
+ * is what 'ssh-keygen -m PKCS8' and openssl give you. Those are almost always
+ * PBES2 with PBKDF2 and AES-CBC, so that's what we handle here.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PEMEncryptedPKCS8 is the PEM block type of encrypted PKCS#8 keys.
+const PEMEncryptedPKCS8 = "ENCRYPTED PRIVATE KEY"
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPKCS8 struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// The decryptPKCS8 function takes the DER bytes of an encrypted PKCS#8 key
+// and a passphrase, and gives back the private key. A wrong passphrase shows
+// up as x509.IncorrectPasswordError, same as from the SSH library.
+func decryptPKCS8(der, passphrase []byte) (interface{}, error) {
+	var ek encryptedPKCS8
+	if _, err := asn1.Unmarshal(der, &ek); err != nil {
+		return nil, err
+	}
+	if !ek.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, errors.New("Unsupported PKCS#8 encryption: " + ek.Algo.Algorithm.String())
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(ek.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, errors.New("Unsupported PKCS#8 key derivation: " + params.KeyDerivationFunc.Algorithm.String())
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	default:
+		return nil, errors.New("Unsupported PKCS#8 PRF: " + kdf.PRF.Algorithm.String())
+	}
+	var keyLen int
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keyLen = 16
+	case scheme.Equal(oidAES192CBC):
+		keyLen = 24
+	case scheme.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, errors.New("Unsupported PKCS#8 cipher: " + scheme.String())
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	data := ek.EncryptedData
+	if len(iv) != aes.BlockSize || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("Malformed encrypted PKCS#8 key")
+	}
+	key := pbkdf2.Key(passphrase, kdf.Salt, kdf.Iterations, keyLen, prf)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	// Bad padding is what a wrong passphrase usually looks like.
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize ||
+		!bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, x509.IncorrectPasswordError
+	}
+	raw, err := x509.ParsePKCS8PrivateKey(plain[:len(plain)-pad])
+	if err != nil {
+		return nil, x509.IncorrectPasswordError
+	}
+	return raw, nil
+}
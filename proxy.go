@@ -22,7 +22,9 @@ import (
 // be used to proxy a connection to another host. This is in practice only used
 // by bastion hosts though.
 func proxyConnect(req proxyRequest, e Env, client *ssh.Client) {
-	dest := req.target + ":" + SSHPort
+	oc := e.s.GetOpenSSHConfig()
+	hc := oc.Lookup(req.target)
+	dest := hc.address(req.target)
 	timeout := make(chan bool, 1)
 	proxyclient := make(chan proxyResponse)
 
@@ -36,6 +38,9 @@ func proxyConnect(req proxyRequest, e Env, client *ssh.Client) {
 	go func(done chan<- proxyResponse) {
 		var localConfig = new(ssh.ClientConfig)
 		*localConfig = *(e.s.GetSSHConfig())
+		offered := hc.apply(localConfig, oc, e.s.GetIdentities())
+		applyTargetUser(localConfig, req.target, e)
+		applyLinkUser(localConfig, req.target)
 		if e.c.Password {
 			pwClosure := func() (string, error) {
 				host := e.s.GetPTR(req.target)
@@ -49,13 +54,16 @@ func proxyConnect(req proxyRequest, e Env, client *ssh.Client) {
 		}
 		conn, err := client.Dial("tcp", dest)
 		if err != nil {
-			done <- proxyResponse{err: err}
+			done <- proxyResponse{err: stageError(stageProxy, err)}
 			return
 		}
+		if req.closed != nil {
+			conn = &notifyConn{conn, req.closed}
+		}
 		e.s.SetConnWaitState(req.target, stateEstablishing)
 		ncc, chans, reqs, err := ssh.NewClientConn(conn, dest, localConfig)
 		if err != nil {
-			done <- proxyResponse{err: err}
+			done <- proxyResponse{err: withOffered(stageError(stageHandshake, err), offered)}
 			return
 		}
 		e.s.SetConnWaitState(req.target, stateNewClient)
@@ -79,16 +87,18 @@ func proxyConnect(req proxyRequest, e Env, client *ssh.Client) {
 	case organic := <-timeout:
 		var retErr error
 		if organic {
-			retErr = errors.New("Remote connection timed out.")
+			retErr = kindError(kindTimeout, stageProxy, errors.New("Remote connection timed out."))
 		} else {
-			retErr = errors.New("Remote connection aborted.")
+			retErr = kindError(kindAbort, stageProxy, errors.New("Remote connection aborted."))
 		}
 		req.response <- proxyResponse{err: retErr}
 		// No goroutines left behind.
 		go func() {
-			<-proxyclient
-			// resp := <-proxyclient
-			// Debug("%s caught a proxy straggler: %v\n", dest, resp)
+			// Close stragglers, they'd count against the bastion forever.
+			resp := <-proxyclient
+			if resp.client != nil {
+				resp.client.Close()
+			}
 		}()
 		return
 	}
@@ -0,0 +1,132 @@
+/*
+ * reconcile.go
+ *
+ * Running 'target' again only ever adds hosts, the ones we already have are
+ * skipped and the ones that have gone from the inventory stay put. With
+ * 'target --sync', the inventory is the truth: new hosts are added and
+ * connected, hosts that have gone are disconnected, which takes their
+ * ControlMaster sockets with them, and dropped. Hosts whose chain or user
+ * changed get reconnected the new way, and everyone else just picks up any
+ * new tags and meta. Bastions that none of the targets go through anymore
+ * are disconnected as well.
+ *
+ * An empty inventory is more likely a broken one than a wish to drop every
+ * target, so that takes 'target --sync --force'.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+var errEmptySync = errors.New("The inventory is empty, so that would remove every target. Use target --sync --force if that's really what you want.")
+
+// A syncReport says what reconcileTargets did.
+type syncReport struct {
+	added     []string
+	removed   []string
+	changed   []string
+	unchanged int
+}
+
+// The fresh method returns the hosts that need connecting.
+func (sr syncReport) fresh() []string {
+	return append(append([]string{}, sr.added...), sr.changed...)
+}
+
+// The reconcileTargets function makes the targets match servers. It's up to
+// the caller to connect the new ones. Unless force is set, it won't take an
+// empty servers as a reason to remove everything.
+func reconcileTargets(e Env, servers []Server, force bool) (syncReport, error) {
+	var sr syncReport
+	hk := e.s.GetHostKeys()
+	if len(servers) == 0 && len(hk) > 0 && !force {
+		return sr, errEmptySync
+	}
+	j := NewJSON(e)
+	want := make(map[string]HostInfo, len(servers))
+	var names []string
+	for i := range servers {
+		if _, exists := want[servers[i].Name]; exists {
+			e.o.Debug("Duplicate HostInfo entry for: %s\n", servers[i].Name)
+			continue
+		}
+		want[servers[i].Name] = j.hostInfo(servers[i])
+		names = append(names, servers[i].Name)
+	}
+	for i := range hk {
+		if _, exists := want[hk[i]]; !exists {
+			removeTarget(e, hk[i])
+			sr.removed = append(sr.removed, hk[i])
+		}
+	}
+	for _, name := range names {
+		hi := want[name]
+		old, err := e.s.GetHostInfo(name)
+		switch {
+		case err != nil:
+			e.s.SetHostInfo(hi)
+			sr.added = append(sr.added, name)
+		case !sameRoute(old, hi):
+			removeTarget(e, name)
+			e.s.SetHostInfo(hi)
+			sr.changed = append(sr.changed, name)
+		default:
+			e.s.SetHostTags(name, hi.tags, hi.meta)
+			sr.unchanged++
+		}
+	}
+	if len(sr.removed) > 0 || len(sr.changed) > 0 {
+		if n := pruneProxies(e); n > 0 {
+			e.o.Debug("Disconnected %d bastions nobody uses anymore.\n", n)
+		}
+	}
+	sort.Strings(sr.added)
+	sort.Strings(sr.removed)
+	sort.Strings(sr.changed)
+	return sr, nil
+}
+
+// The syncTargets function reconciles the targets with servers, says what
+// changed, and connects the new hosts.
+func syncTargets(e Env, servers []Server, force bool) error {
+	sr, err := reconcileTargets(e, servers, force)
+	if err != nil {
+		return err
+	}
+	outputSyncReport(e, sr)
+	if fresh := sr.fresh(); len(fresh) > 0 {
+		connectEverywhere(e, fresh, e.c.Timeout, noRetries)
+	}
+	return nil
+}
+
+// The sameRoute function tells us if we'd connect to a host the same way.
+func sameRoute(a, b HostInfo) bool {
+	if a.user != b.user || len(a.chain) != len(b.chain) {
+		return false
+	}
+	for i := range a.chain {
+		if a.chain[i] != b.chain[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func outputSyncReport(e Env, sr syncReport) {
+	e.o.Out("Added %d, removed %d, changed %d, unchanged %d.\n",
+		len(sr.added), len(sr.removed), len(sr.changed), sr.unchanged)
+	for _, h := range sr.added {
+		e.o.Out("\t+ %s\n", h)
+	}
+	for _, h := range sr.removed {
+		e.o.Out("\t- %s\n", h)
+	}
+	for _, h := range sr.changed {
+		e.o.Out("\t~ %s\n", h)
+	}
+}
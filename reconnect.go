@@ -0,0 +1,333 @@
+/*
+ * reconnect.go
+ *
+ * This file has the reconnect supervisor. When a keep-alive fails, or the
+ * connection goes away under us, the host is disconnected and would otherwise
+ * silently drop out of the connection map. Keep-alives catch links that die
+ * without closing, but we don't need them to notice the ones that do close.
+ * If reconnecting is enabled, we keep re-resolving the host (or bastion) with
+ * exponential backoff until it comes back, or until nobody targets it
+ * anymore. A host that comes back gets its ControlMaster socket rebuilt at
+ * the same path by remoteHost.
+ *
+ */
+
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The hostLost function is called from remoteHost when a connection has gone
+// bad. It disconnects the host, records the flap, and kicks off the reconnect
+// supervisor if we've been asked to do that.
+func hostLost(e Env, me string, isProxy bool, lostErr error) {
+	via := ""
+	if ci, err := e.s.GetConnInfo(me); err == nil {
+		via = ci.via
+	}
+	if err := disconnectHost(e, me); err != nil {
+		e.o.Debug("disconnectHost: %s\n", err)
+	}
+	e.s.RecordFlap(me, isProxy, flapLost, lostErr)
+	// A bastion with alternatives gets moved over to one of the others
+	// right away, along with everything that was behind it.
+	if isProxy && strings.Contains(me, "|") {
+		if via != "" {
+			e.s.SetAltDown(via, true)
+		}
+		if failover(e, me) {
+			return
+		}
+	}
+	if !isProxy && e.s.HostExists(me) {
+		e.s.SetConnectionStatus(setConnectionStatus{
+			hostName:    me,
+			connectedOK: false,
+			lastError:   lostErr,
+			lost:        true,
+		})
+	}
+	if e.c.Reconnect {
+		reconnectHost(e, me, isProxy)
+	}
+}
+
+// The reconnectHost function is the reconnect supervisor for a single host.
+// Only one of these runs per host at a time.
+func reconnectHost(e Env, host string, isProxy bool) {
+	if !e.s.StartReconnect(host) {
+		e.o.Debug("%s: already reconnecting.\n", host)
+		return
+	}
+	defer e.s.StopReconnect(host)
+
+	cancel := e.s.GetReconnectCancel()
+	maxWait := time.Duration(e.c.ReconnectMax) * time.Second
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(backoff(attempt, time.Second, maxWait)):
+		case <-cancel:
+			e.o.Debug("%s: reconnect cancelled.\n", host)
+			e.s.RecordFlap(host, isProxy, flapAbandoned, nil)
+			return
+		}
+		if e.s.ConnExists(host) {
+			// Somebody else (like the connect command) beat us to it.
+			return
+		}
+		chain := reconnectChain(e, host, isProxy)
+		if chain == nil {
+			// It was removed, so there's no history worth keeping.
+			e.o.Debug("%s: no longer targeted, giving up.\n", host)
+			e.s.ForgetHost(host)
+			return
+		}
+		e.o.Debug("%s: reconnect attempt %d via %v\n", host, attempt+1, chain)
+		startTime := time.Now()
+		var err error
+		// Like connectEverywhere, get the proxies up first so they are
+		// marked as proxies and don't get ControlMaster sockets.
+		if !isProxy && len(chain) > 1 {
+			err = resolve(chain[:len(chain)-1], e, true, e.c.Timeout)
+		}
+		if err == nil {
+			err = resolve(chain, e, isProxy, e.c.Timeout)
+		}
+		if err == nil && e.s.ConnExists(host) {
+			e.s.RecordFlap(host, isProxy, flapRestored, nil)
+			if !isProxy {
+				e.s.SetConnectionStatus(setConnectionStatus{
+					hostName:    host,
+					connectedOK: true,
+					connectTime: time.Since(startTime),
+				})
+			}
+			return
+		}
+		e.s.RecordFlap(host, isProxy, flapFailed, err)
+	}
+}
+
+// The failover function reconnects a bastion hop like 'bastion-a|bastion-b'
+// through whichever alternative still works, and then moves the hosts that
+// were behind it over. It returns false if no alternative would have us.
+func failover(e Env, hop string) bool {
+	if !e.s.StartReconnect(hop) {
+		e.o.Debug("%s: already reconnecting.\n", hop)
+		return true
+	}
+	chain := reconnectChain(e, hop, true)
+	if chain == nil {
+		e.s.StopReconnect(hop)
+		e.o.Debug("%s: no longer targeted, not failing over.\n", hop)
+		return true
+	}
+	err := resolve(chain, e, true, e.c.Timeout)
+	e.s.StopReconnect(hop)
+	if err != nil {
+		e.o.Debug("%s: failover failed: %s\n", hop, err)
+		e.s.RecordFlap(hop, true, flapFailed, err)
+		return false
+	}
+	ci, err := e.s.GetConnInfo(hop)
+	if err != nil {
+		return false
+	}
+	e.o.Debug("%s: failed over to %s\n", hop, ci.via)
+	e.s.RecordFlap(hop, true, flapFailover, nil)
+
+	// Everything behind the old bastion is dead in the water, whether
+	// their keep-alives have noticed yet or not. Like resolveProxies, we
+	// do the bastions further down serially so they don't get connected
+	// more than once, and then move the hosts over in parallel.
+	hosts := downstreamHosts(e, hop)
+	chains := make(map[string]bool)
+	for i := range hosts {
+		hi, err := e.s.GetHostInfo(hosts[i])
+		if err != nil {
+			continue
+		}
+		proxies := hi.chain[:len(hi.chain)-1]
+		for j := range proxies {
+			proxy := e.s.GetPTR(proxies[j])
+			if chainHas(proxies[:j], hop, e) && e.s.ConnExists(proxy) {
+				if err := disconnectHost(e, proxy); err != nil {
+					e.o.Debug("disconnectHost: %s\n", err)
+				}
+			}
+		}
+		chains[strings.Join(proxies, " ")] = true
+	}
+	for chain := range chains {
+		if err := resolve(strings.Split(chain, " "), e, true, e.c.Timeout); err != nil {
+			e.o.Debug("%s: couldn't reconnect %s: %s\n", hop, chain, err)
+		}
+	}
+	var wg sync.WaitGroup
+	limiter := make(chan struct{}, e.c.Concurrency)
+	for i := range hosts {
+		wg.Add(1)
+		limiter <- struct{}{}
+		go func(host string) {
+			defer func() { wg.Done(); <-limiter }()
+			moveHost(e, host)
+		}(hosts[i])
+	}
+	wg.Wait()
+	return true
+}
+
+// The moveHost function reconnects a single host whose chain goes through a
+// bastion that just failed over.
+func moveHost(e Env, host string) {
+	if !e.s.StartReconnect(host) {
+		return
+	}
+	defer e.s.StopReconnect(host)
+	hi, err := e.s.GetHostInfo(host)
+	if err != nil {
+		return
+	}
+	if e.s.ConnExists(host) {
+		if err := disconnectHost(e, host); err != nil {
+			e.o.Debug("disconnectHost: %s\n", err)
+		}
+	}
+	startTime := time.Now()
+	err = resolve(hi.chain, e, false, e.c.Timeout)
+	if err != nil {
+		e.s.RecordFlap(host, false, flapFailed, err)
+	} else {
+		e.s.RecordFlap(host, false, flapFailover, nil)
+	}
+	e.s.SetConnectionStatus(setConnectionStatus{
+		hostName:    host,
+		connectedOK: err == nil,
+		connectTime: time.Since(startTime),
+		lastError:   err,
+	})
+}
+
+// The downstreamHosts function returns the targets whose chains go through
+// the given bastion hop.
+func downstreamHosts(e Env, hop string) []string {
+	var hosts []string
+	hk := e.s.GetHostKeys()
+	for i := range hk {
+		hi, err := e.s.GetHostInfo(hk[i])
+		if err != nil {
+			continue
+		}
+		if chainHas(hi.chain[:len(hi.chain)-1], hop, e) {
+			hosts = append(hosts, hk[i])
+		}
+	}
+	return hosts
+}
+
+func chainHas(chain []string, hop string, e Env) bool {
+	for i := range chain {
+		if e.s.GetPTR(chain[i]) == hop {
+			return true
+		}
+	}
+	return false
+}
+
+// The reconnectChain function figures out the chain we need to resolve to get
+// back to a host. Targets have their own chain, while bastions get the part of
+// any target's chain that leads up to them. A nil chain means that the host is
+// not needed anymore.
+func reconnectChain(e Env, host string, isProxy bool) []string {
+	if !isProxy {
+		hi, err := e.s.GetHostInfo(host)
+		if err != nil {
+			return nil
+		}
+		return hi.chain
+	}
+	hk := e.s.GetHostKeys()
+	for i := range hk {
+		hi, err := e.s.GetHostInfo(hk[i])
+		if err != nil {
+			continue
+		}
+		for idx := 0; idx < len(hi.chain)-1; idx++ {
+			if e.s.GetPTR(hi.chain[idx]) == host {
+				return hi.chain[:idx+1]
+			}
+		}
+	}
+	return nil
+}
+
+// The backoff function returns how long to wait before the given attempt. The
+// wait doubles every attempt up to max, and the second half of it is jittered
+// so a whole rack's worth of hosts doesn't stampede the bastions at once.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	wait := max
+	if attempt < 32 && min<<uint(attempt) < max {
+		wait = min << uint(attempt)
+	}
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// The outputFlaps function shows the reconnect counts and, if verbose, the
+// flap history for every host that has ever dropped its connection.
+func outputFlaps(e Env, verbose bool) {
+	flaps := e.s.GetFlapInfo()
+	if len(flaps) == 0 {
+		return
+	}
+	reconnects := 0
+	reconnecting := 0
+	counts := make(map[string]int)
+	byName := make(map[string]FlapInfo)
+	for i := range flaps {
+		fi := flaps[i]
+		reconnects += fi.reconnects
+		if fi.reconnecting {
+			reconnecting++
+		}
+		counts[fi.hostName] = len(fi.history)
+		byName[fi.hostName] = fi
+	}
+	e.o.Out(
+		"%d hosts flapped (%d reconnects, %d reconnecting)\n",
+		len(flaps),
+		reconnects,
+		reconnecting,
+	)
+	if !verbose {
+		return
+	}
+	hosts := sortedIntKeys(counts)
+	for i := range hosts {
+		fi := byName[hosts[i]]
+		what := "host"
+		if fi.isProxy {
+			what = "proxy"
+		}
+		e.o.Out(
+			"\t%s (%s): %d reconnects, %d failed attempts\n",
+			fi.hostName,
+			what,
+			fi.reconnects,
+			fi.failures,
+		)
+		for j := range fi.history {
+			fe := fi.history[j]
+			ago := time.Since(fe.when).Seconds()
+			if fe.err != nil {
+				e.o.Out("\t\t%.0fs ago: %s (%s)\n", ago, fe.event, fe.err)
+			} else {
+				e.o.Out("\t\t%.0fs ago: %s\n", ago, fe.event)
+			}
+		}
+	}
+}
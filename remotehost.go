@@ -10,7 +10,10 @@
 package main
 
 import (
+	"errors"
 	"math/rand"
+	"net"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -25,19 +28,32 @@ type proxyRequest struct {
 	target   string
 	response chan<- proxyResponse
 	timeout  int
+	closed   func() // If set, called when the proxied connection closes
 }
 
 type runRequest struct {
 	cmd      string
 	response chan<- runResponse
 	timeout  int
+	spoolDir string // Where to spool the output, if anywhere
 }
 
 type runResponse struct {
-	stdOut   string
-	stdErr   string
-	exitCode int
-	err      error
+	stdOut    string
+	stdErr    string
+	outputSum string // Of all the output, even if it was spooled
+	exitCode  int
+	err       error
+}
+
+type dialRequest struct {
+	addr     string
+	response chan<- dialResponse
+}
+
+type dialResponse struct {
+	conn net.Conn
+	err  error
 }
 
 type cleanupResponse struct {
@@ -51,44 +67,77 @@ type cleanupRequest struct {
 // The remoteHost function runs once for every SSH connection, all it does is
 // listen on the request channel and dispatches commands.
 //
-// For bastion hosts, we can have a number of these goroutines all listening
-// on one common channel, but each having an independent SSH client connection
-// to the bastion host, as to not spam a single bastion connection too hard.
-func remoteHost(me string, id int, listen <-chan interface{}, e Env, client *ssh.Client, isProxy bool) {
+// For bastion hosts, we can have a number of these goroutines each having an
+// independent SSH client connection to the bastion host, as to not spam a
+// single bastion connection too hard. A balancer sits in front of them and
+// gets told through lost when one of them goes away, otherwise we go straight
+// to hostLost.
+func remoteHost(me string, id int, listen <-chan interface{}, e Env, client *ssh.Client, isProxy bool, lost func(error)) {
 	var m *Mux
 	var nmErr error
 
+	// The ControlMaster socket is named after the port we actually
+	// connected to, just like %p in an OpenSSH ControlPath.
+	_, port := e.s.GetOpenSSHConfig().Lookup(me).hostPort(me)
 	if host := e.s.GetPTR(me); host != "" {
 		me = host
 	}
-	e.o.Debug("remoteHost(): running for %s\n", me)
+	e.o.Debug("remoteHost(): running for %s (%d)\n", me, id)
+	if lost == nil {
+		lost = func(err error) { hostLost(e, me, isProxy, err) }
+	}
+	// The keep-alives and the watcher below can both notice the same
+	// loss, but it only gets reported once. Whatever it was, it happened
+	// to a connection that was up, so it's classified as such.
+	var lostOnce sync.Once
+	reportLost := func(err error) {
+		err = stageError(stageSession, err)
+		lostOnce.Do(func() { go lost(err) })
+	}
 
 	// We keep a session around just for keep-alives.
 	session, err := client.NewSession()
 	if err != nil {
 		e.o.Debug("%s: NewSession() failed: %s\n", me, err)
-		go func() {
-			err := disconnectHost(e, me)
-			if err != nil {
-				e.o.Debug("disconnectHost: %s\n", err)
-			}
-		}()
+		reportLost(err)
 	}
 	keepAliveChan := make(chan bool)
+	doneChan := make(chan bool)
+	defer close(doneChan)
+	// Without keep-alives, the connection going away is how we find out
+	// it's gone, unless we're the ones closing it.
+	closing := make(chan struct{})
+	go func() {
+		err := client.Wait()
+		select {
+		case <-closing:
+			return
+		default:
+		}
+		if err == nil {
+			err = errors.New("Connection closed by remote host.")
+		}
+		e.o.Debug("%s: connection lost: %s\n", me, err)
+		reportLost(err)
+	}()
 	if e.c.KeepAlive > 0 {
 		go func() {
 			splay := rand.Intn(59) + 1
 			time.Sleep(time.Duration(splay) * time.Second)
 			for {
 				time.Sleep(time.Duration(e.c.KeepAlive) * time.Second)
-				keepAliveChan <- true
+				select {
+				case keepAliveChan <- true:
+				case <-doneChan:
+					return
+				}
 			}
 		}()
 	}
 	// Proxies don't get ControlMaster sockets.
 	// Only create ControlMaster sockets if we're in server mode.
 	if !isProxy && e.c.Server {
-		m, nmErr = NewMux(me, client, e)
+		m, nmErr = NewMux(me, port, client, e)
 		if nmErr != nil {
 			e.o.Debug("NewMux() failed: %s\n", nmErr)
 		}
@@ -103,9 +152,16 @@ func remoteHost(me string, id int, listen <-chan interface{}, e Env, client *ssh
 			case runRequest:
 				rReq := req.(runRequest)
 				go runCmd(me, rReq, client, e)
+			case dialRequest:
+				dReq := req.(dialRequest)
+				go func() {
+					conn, err := client.Dial("tcp", dReq.addr)
+					dReq.response <- dialResponse{conn, err}
+				}()
 			case cleanupRequest:
 				allGood := true
 				cReq := req.(cleanupRequest)
+				close(closing)
 				if session != nil {
 					err := session.Close()
 					if err != nil {
@@ -129,13 +185,11 @@ func remoteHost(me string, id int, listen <-chan interface{}, e Env, client *ssh
 			if session != nil {
 				_, err := session.SendRequest(KeepAlive, true, nil)
 				if err != nil {
-					e.o.Debug("%s Keep alive failed: %s\n", err)
-					go func() {
-						err := disconnectHost(e, me)
-						if err != nil {
-							e.o.Debug("disconnectHost: %s\n", err)
-						}
-					}()
+					e.o.Debug("%s: Keep alive failed: %s\n", me, err)
+					// Don't keep tripping over the same dead session
+					// while we wait for the cleanup request.
+					session = nil
+					reportLost(err)
 				}
 			}
 		}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemoteHostLostIsClassified(t *testing.T) {
+	client := fakeSSHServer(t)
+	e, _ := testEnv()
+	lost := make(chan error, 1)
+	go remoteHost("web-1", 0, make(chan interface{}), e, client, false, func(err error) { lost <- err })
+	// Pulling the connection out from under it, rather than asking it to
+	// clean up, looks just like the far end going away.
+	client.Close()
+	select {
+	case err := <-lost:
+		if got := errorLabel(err); got != "session (session)" {
+			t.Errorf("got %q for %v, want %q", got, err, "session (session)")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lost connection was never reported")
+	}
+}
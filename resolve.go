@@ -17,6 +17,8 @@
 package main
 
 import (
+	"errors"
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -27,112 +29,205 @@ import (
 // The resolve function figures out how to get there from here. Based on the
 // in chain slice it will proxy through as many hosts as necessary to get to
 // the final destination, which is the last element in the slice.
+//
+// A hop can list alternatives like 'bastion-a|bastion-b'. They get tried in
+// order, except that ones we've seen die get tried last, and whichever one
+// works is used for the whole hop.
 func resolve(chain []string, e Env, isProxy bool, timeout int) error {
+	var dial dialFunc
 	e.o.Debug("resolve() chain: %v, isProxy: %v, timeout: %v\n", chain, isProxy, timeout)
+	// A SOCKS5 or HTTP proxy up front isn't a hop we SSH into, it's just
+	// how we dial the first real hop.
+	if len(chain) > 0 && isNetProxy(chain[0]) {
+		var err error
+		if dial, err = netProxyDialer(chain[0]); err != nil {
+			return err
+		}
+		chain = chain[1:]
+	}
 	for idx, link := range chain {
-		proxy := idx - 1
-		if proxy >= 0 {
-			e.o.Debug("resolve(): Using a proxy.\n")
-			// This machine has a proxy
-			proxyhost := chain[proxy]
-			// We're outta here if we've already done this one.
-			if e.s.ConnExists(link) {
-				continue
+		// We're outta here if we've already done this one.
+		if e.s.ConnExists(e.s.GetPTR(link)) {
+			e.o.Debug("resolve(): %s connection already exists.\n", link)
+			continue
+		}
+		var err error
+		alts := alternatives(e, link)
+		for i := range alts {
+			if idx > 0 {
+				err = proxiedResolve(link, alts[i], chain[idx-1], e, isProxy, timeout)
+			} else {
+				err = directResolve(link, alts[i], e, isProxy, timeout, dial)
 			}
-			// Let's send the proxy a message asking it to create a con for us.
-			respChan := make(chan proxyResponse)
-			req := proxyRequest{link, respChan, timeout}
-			ci, err := e.s.GetConnInfo(proxyhost)
-			if err != nil {
-				e.o.Debug("GetConnInfo(): %s\n", err)
-				continue
+			if err == nil {
+				e.s.SetAltDown(alts[i], false)
+				break
 			}
-			ci.reqChan <- req
-			resp := <-respChan
-			if resp.err != nil {
-				return resp.err
+			if len(alts) > 1 {
+				e.o.Debug("resolve(): %s failed: %s, trying the next one.\n", alts[i], err)
+				e.s.SetAltDown(alts[i], true)
 			}
-			e.s.IncProxyCount(proxyhost)
-			newreq := make(chan interface{})
-			go remoteHost(link, 0, newreq, e, resp.client, isProxy)
-			e.s.SetConnInfo(&ConnInfo{
-				hostName: link,
-				reqChan:  newreq,
-				isProxy:  isProxy,
-				isDirect: false,
-			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The alternatives function splits a chain hop into the hosts it can be
+// reached at, with the ones that are known to be down moved to the back.
+func alternatives(e Env, link string) []string {
+	alts := strings.Split(link, "|")
+	if len(alts) == 1 {
+		return alts
+	}
+	var up, down []string
+	for i := range alts {
+		if e.s.IsAltDown(alts[i]) {
+			down = append(down, alts[i])
 		} else {
-			// This is a direct connect.
-			e.o.Debug("resolve(): Direct connect to: %s\n", link)
-			if e.s.ConnExists(link) {
-				e.o.Debug("resolve(): %s connection already exists.\n", link)
-				continue
-			}
-			reqChan := make(chan interface{})
-			var localConfig = new(ssh.ClientConfig)
-			*localConfig = *(e.s.GetSSHConfig())
-			if e.c.Password {
-				pwClosure := func() (string, error) {
-					host := e.s.GetPTR(link)
-					e.s.SetRequiresPw(host)
-					return e.s.GetAuthPass(), nil
-				}
-				localConfig.Auth = append(
-					localConfig.Auth,
-					ssh.PasswordCallback(pwClosure),
-				)
-			}
-			var wg sync.WaitGroup
-			for i := 0; i < e.c.BastionConns; i++ {
-				wg.Add(1)
-				go func(id int) {
-					defer wg.Done()
-					timeoutChan := make(chan bool, 1)
-					dialChan := make(chan *ssh.Client)
-					errChan := make(chan error)
-
-					go directConnect(link, dialChan, errChan, localConfig)
-					go sleep(timeoutChan, timeout)
+			up = append(up, alts[i])
+		}
+	}
+	return append(up, down...)
+}
+
+// The proxiedResolve function asks the proxy in front of link to connect us
+// to alt, one of link's alternatives.
+func proxiedResolve(link, alt, proxy string, e Env, isProxy bool, timeout int) error {
+	e.o.Debug("resolve(): Using a proxy.\n")
+	proxyhost := e.s.GetPTR(proxy)
+	ci, err := e.s.GetConnInfo(proxyhost)
+	if err != nil {
+		return kindError(kindProxy, stageProxy, err)
+	}
+	// Let's send the proxy a message asking it to create a con for us.
+	respChan := make(chan proxyResponse)
+	ci.reqChan <- proxyRequest{alt, respChan, timeout, nil}
+	resp := <-respChan
+	if resp.err != nil {
+		return resp.err
+	}
+	e.s.IncProxyCount(proxyhost)
+	newreq := make(chan interface{})
+	go remoteHost(link, 0, newreq, e, resp.client, isProxy, nil)
+	e.s.SetConnInfo(&ConnInfo{
+		hostName: link,
+		reqChan:  newreq,
+		isProxy:  isProxy,
+		isDirect: false,
+		via:      alt,
+	})
+	return nil
+}
 
+// The directResolve function connects us straight to alt, one of link's
+// alternatives. Bastions get --bastionconns connections with a balancer in
+// front of them.
+func directResolve(link, alt string, e Env, isProxy bool, timeout int, dial dialFunc) error {
+	// This is a direct connect.
+	e.o.Debug("resolve(): Direct connect to: %s\n", alt)
+	reqChan := make(chan interface{})
+	var localConfig = new(ssh.ClientConfig)
+	*localConfig = *(e.s.GetSSHConfig())
+	oc := e.s.GetOpenSSHConfig()
+	hc := oc.Lookup(alt)
+	offered := hc.apply(localConfig, oc, e.s.GetIdentities())
+	applyTargetUser(localConfig, link, e)
+	applyLinkUser(localConfig, alt)
+	if e.c.Password {
+		pwClosure := func() (string, error) {
+			host := e.s.GetPTR(link)
+			e.s.SetRequiresPw(host)
+			return e.s.GetAuthPass(), nil
+		}
+		localConfig.Auth = append(
+			localConfig.Auth,
+			ssh.PasswordCallback(pwClosure),
+		)
+	}
+	// Only bastions get more than one connection.
+	conns := 1
+	if isProxy {
+		conns = e.c.BastionConns
+	}
+	clients := make(chan *ssh.Client, conns)
+	errs := make(chan error, conns)
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			timeoutChan := make(chan bool, 1)
+			dialChan := make(chan *ssh.Client)
+			errChan := make(chan error)
+
+			go directConnect(alt, dialChan, errChan, localConfig, hc, dial)
+			go sleep(timeoutChan, timeout)
+
+			select {
+			case sshClient := <-dialChan:
+				clients <- sshClient
+				go func() { <-timeoutChan }()
+			case dcErr := <-errChan:
+				e.o.Debug("resolve(): Err: %s from directConnect\n", dcErr)
+				errs <- withOffered(dcErr, offered)
+				go func() { <-timeoutChan }()
+				return
+			case <-timeoutChan:
+				errs <- kindError(kindTimeout, stageDial, errors.New("Connection timed out."))
+				go func() {
 					select {
+					case <-errChan:
 					case sshClient := <-dialChan:
-						go remoteHost(link, id, reqChan, e, sshClient, isProxy)
-						e.s.SetConnInfo(&ConnInfo{
-							hostName: link,
-							reqChan:  reqChan,
-							isProxy:  isProxy,
-							isDirect: true,
-						})
-						go func() { <-timeoutChan }()
-					case dcErr := <-errChan:
-						e.o.Debug("resolve(): Err: %s from directConnect\n", dcErr)
-						go func() { <-timeoutChan }()
-						return
-					case <-timeoutChan:
-						go func() {
-							select {
-							case <-errChan:
-							case <-dialChan:
-								// Debug("Caught a direct straggler.\n")
-								return
-							}
-						}()
+						// Debug("Caught a direct straggler.\n")
+						sshClient.Close()
 						return
 					}
-					return
-				}(i)
+				}()
+				return
 			}
-			wg.Wait()
+			return
+		}()
+	}
+	wg.Wait()
+	close(clients)
+	close(errs)
+	var connected []*ssh.Client
+	for sshClient := range clients {
+		connected = append(connected, sshClient)
+	}
+	if len(connected) == 0 {
+		return <-errs
+	}
+	if isProxy {
+		// The balancer opens more connections with this when the ones
+		// we have get busy.
+		more := func() (*ssh.Client, error) {
+			var moreConfig = new(ssh.ClientConfig)
+			*moreConfig = *localConfig
+			moreConfig.Timeout = time.Duration(timeout) * time.Second
+			return dialHost(alt, moreConfig, hc, dial)
 		}
+		reqChan = newBalancer(link, connected, more, e)
+	} else {
+		go remoteHost(link, 0, reqChan, e, connected[0], isProxy, nil)
 	}
+	e.s.SetConnInfo(&ConnInfo{
+		hostName: link,
+		reqChan:  reqChan,
+		isProxy:  isProxy,
+		isDirect: true,
+		via:      alt,
+	})
 	return nil
 }
 
 // The directConnect function will connect you directly to a host, not through
 // a proxy. Used when setting up proxies initially.
-func directConnect(link string, done chan<- *ssh.Client, echan chan<- error, cfg *ssh.ClientConfig) {
-	// dest := link + ":" + SSHPort
-	client, err := ssh.Dial("tcp", link, cfg)
+func directConnect(link string, done chan<- *ssh.Client, echan chan<- error, cfg *ssh.ClientConfig, hc sshHostConfig, dial dialFunc) {
+	client, err := dialHost(link, cfg, hc, dial)
 	if err != nil {
 		echan <- err
 		return
@@ -141,6 +236,50 @@ func directConnect(link string, done chan<- *ssh.Client, echan chan<- error, cfg
 	return
 }
 
+// The splitLink function splits a chain link into its host and port. Links
+// can be a plain host, host:port, or a bracketed IPv6 address with or without
+// a port, any of them with a user@ in front, which is left off. If there is
+// no port, you get back an empty string for it.
+func splitLink(link string) (string, string) {
+	_, link = linkUser(link)
+	if host, port, err := net.SplitHostPort(link); err == nil {
+		return host, port
+	}
+	if strings.HasPrefix(link, "[") && strings.HasSuffix(link, "]") {
+		return link[1 : len(link)-1], ""
+	}
+	return link, ""
+}
+
+// The linkUser function splits the user off a user@host link. If there is no
+// user, you get back an empty string for it.
+func linkUser(link string) (string, string) {
+	if at := strings.LastIndex(link, "@"); at >= 0 {
+		return link[:at], link[at+1:]
+	}
+	return "", link
+}
+
+// The applyLinkUser function logs in as the user given in the link itself,
+// if there is one. That beats every other place a user can come from.
+func applyLinkUser(cfg *ssh.ClientConfig, link string) {
+	if user, _ := linkUser(link); user != "" {
+		cfg.User = user
+	}
+}
+
+// The joinLink function is the opposite of splitLink, but it leaves the port
+// off if it's the stock SSH port.
+func joinLink(host, port string) string {
+	if port == "" || port == SSHPort {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
 func sleep(done chan<- bool, timeout int) {
 	time.Sleep(time.Duration(timeout) * time.Second)
 	done <- true
@@ -164,7 +303,10 @@ func resolveProxies(e Env) error {
 		hostname := hk[j]
 		hi, err := e.s.GetHostInfo(hostname)
 		if err != nil {
-			return err
+			// It was removed since we got the keys, so there's
+			// nothing to connect it through.
+			e.o.Debug("GetHostInfo(): %s\n", err)
+			continue
 		}
 		length := len(hi.chain)
 		if length == 1 {
@@ -177,9 +319,11 @@ func resolveProxies(e Env) error {
 			chainMap[chain] = val + 1
 		} else {
 			chainMap[chain] = 1
+			// Don't give up on everything because of one dead bastion,
+			// the hosts behind it will fail to connect and say why.
 			err := resolve(strings.Split(chain, " "), e, true, e.c.Timeout)
 			if err != nil {
-				e.o.ErrExit("Could not resolve proxy: %s\n", err)
+				e.o.Err("Could not resolve proxy %s: %s\n", chain, err)
 			}
 		}
 	}
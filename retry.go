@@ -0,0 +1,145 @@
+/*
+ * retry.go
+ *
+ * This file has the retry policy used when connecting to hosts. Some errors,
+ * like a dial that got its connection reset or a timeout, are transient, so
+ * instead of leaving a host failed until somebody runs connect again by hand
+ * we can try a few more times. Which errors are worth retrying is given in
+ * terms of the error kinds from errors.go.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetryMaxWait is the longest we'll wait between two connection attempts.
+const RetryMaxWait = 60
+
+// A retryPolicy says how many more times to try connecting to a host, which
+// kinds of errors are worth another try, and how long to back off in between.
+type retryPolicy struct {
+	retries  int
+	retryOn  map[string]bool
+	minWait  time.Duration
+	maxWait  time.Duration
+	anyError bool
+}
+
+// There are no retries unless you ask for them.
+var noRetries = retryPolicy{}
+
+// The newRetryPolicy function builds a retryPolicy from a comma separated list
+// of error kinds. Since the CLI splits on whitespace, dashes or underscores
+// can stand in for the spaces in a kind, e.g. 'host-key'. The special kind
+// 'all' retries any error.
+func newRetryPolicy(retries int, classes string, wait int) (retryPolicy, error) {
+	rp := retryPolicy{
+		retries: retries,
+		retryOn: make(map[string]bool),
+		minWait: time.Duration(wait) * time.Second,
+		maxWait: time.Duration(RetryMaxWait) * time.Second,
+	}
+	if retries < 0 {
+		return rp, errors.New("Number of retries can't be negative.")
+	}
+	if wait <= 0 {
+		return rp, errors.New("Retry wait must be at least one second.")
+	}
+	if rp.minWait > rp.maxWait {
+		rp.maxWait = rp.minWait
+	}
+	for _, class := range strings.Split(classes, ",") {
+		class = strings.ToLower(strings.TrimSpace(class))
+		class = strings.NewReplacer("-", " ", "_", " ").Replace(class)
+		if class == "" {
+			continue
+		}
+		if class == "all" {
+			rp.anyError = true
+			continue
+		}
+		if !knownErrorClass(class) {
+			msg := fmt.Sprintf(
+				"Unknown error kind '%s', try one of: all, %s",
+				class,
+				strings.Join(errorKinds, ", "),
+			)
+			return rp, errors.New(msg)
+		}
+		rp.retryOn[class] = true
+	}
+	return rp, nil
+}
+
+func knownErrorClass(class string) bool {
+	if class == UnknownError {
+		return true
+	}
+	for i := range errorKinds {
+		if errorKinds[i] == class {
+			return true
+		}
+	}
+	return false
+}
+
+// The retryable method returns true if we should try again after the given
+// attempt failed with err.
+func (rp retryPolicy) retryable(attempt int, err error) bool {
+	if err == nil || attempt >= rp.retries {
+		return false
+	}
+	return rp.anyError || rp.retryOn[errorClass(err)]
+}
+
+// The connectWithRetries function resolves the chain for a host, trying again
+// with backoff as long as the policy allows it. It hands back the history of
+// every attempt along with the error from the last one.
+func connectWithRetries(host string, chain []string, e Env, timeout int, rp retryPolicy) ([]connectAttempt, error) {
+	var attempts []connectAttempt
+	for attempt := 0; ; attempt++ {
+		startTime := time.Now()
+		err := resolve(chain, e, false, timeout)
+		attempts = append(attempts, connectAttempt{
+			startTime: startTime,
+			duration:  time.Since(startTime),
+			err:       err,
+		})
+		if !rp.retryable(attempt, err) {
+			return attempts, err
+		}
+		wait := backoff(attempt, rp.minWait, rp.maxWait)
+		e.o.Debug(
+			"%s: attempt %d failed (%s), retrying in %.2fs\n",
+			host,
+			attempt+1,
+			err,
+			wait.Seconds(),
+		)
+		time.Sleep(wait)
+	}
+}
+
+// The outputAttempts function shows the connection attempt history of a host.
+func outputAttempts(e Env, host string) {
+	hi, err := e.s.GetHostInfo(host)
+	if err != nil {
+		e.o.Debug("GetHostInfo(): %s\n", err)
+		return
+	}
+	e.o.Out("\t\t%s\n", host)
+	for i := range hi.attempts {
+		a := hi.attempts[i]
+		result := "ok"
+		if a.err != nil {
+			result = a.err.Error()
+		}
+		e.o.Out("\t\t\t#%d %05.2fs: %s\n", i+1, a.duration.Seconds(), result)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
@@ -34,17 +35,22 @@ func runCmd(me string, req runRequest, client *ssh.Client, e Env) {
 
 	go func(done chan<- runResponse) {
 		var stdOut, stdErr bytes.Buffer
+		var copying sync.WaitGroup
+		oh := newOutputHash()
 		var fpStdOut, fpStdErr, fpRetCode *os.File
 		var exitCode uint32
 		var session *ssh.Session
 		var err error
 
-		if e.c.Spool {
-			fpStdOut, fpStdErr, fpRetCode, err = spoolHandles(e, e.s.GetPTR(me))
+		// Only runs that have a spool directory get spooled.
+		spool := req.spoolDir != ""
+		if spool {
+			fpStdOut, fpStdErr, fpRetCode, err = spoolHandles(e, req.spoolDir, e.s.GetPTR(me))
 			if err != nil {
 				e.o.Err("spoolHandles: %s\n", err)
 				e.o.Err("Spooling is turned OFF, correct and re-enable.\n")
 				e.c.Spool = false
+				spool = false
 			} else {
 				defer func() {
 					err = fpStdOut.Close()
@@ -64,22 +70,22 @@ func runCmd(me string, req runRequest, client *ssh.Client, e Env) {
 		}
 		session, err = client.NewSession()
 		if err != nil {
-			runResp <- runResponse{err: err}
+			runResp <- runResponse{err: stageError(stageSession, err)}
 			return
 		}
 
-		if e.c.Spool {
+		if spool {
 			var stdOutPipe, stdErrPipe, stdOutReader, stdErrReader io.Reader
 			stdOutPipe, err = session.StdoutPipe()
 			if err != nil {
 				e.o.Debug("StdoutPipe(): %s\n", err)
-				done <- runResponse{err: err}
+				done <- runResponse{err: kindError(kindLocal, stageSession, err)}
 				return
 			}
 			stdErrPipe, err = session.StderrPipe()
 			if err != nil {
 				e.o.Debug("StderrPipe(): %s\n", err)
-				done <- runResponse{err: err}
+				done <- runResponse{err: kindError(kindLocal, stageSession, err)}
 				return
 			}
 			if e.c.Tee {
@@ -89,25 +95,28 @@ func runCmd(me string, req runRequest, client *ssh.Client, e Env) {
 				stdOutReader = stdOutPipe
 				stdErrReader = stdErrPipe
 			}
+			copying.Add(2)
 			go func() {
-				_, cpErr := io.Copy(fpStdOut, stdOutReader)
+				defer copying.Done()
+				_, cpErr := io.Copy(io.MultiWriter(fpStdOut, oh.stdOut), stdOutReader)
 				if cpErr != nil {
 					e.o.Debug("fpStdOut io.Copy: %s\n", cpErr)
 				}
 			}()
 			go func() {
-				_, cpErr := io.Copy(fpStdErr, stdErrReader)
+				defer copying.Done()
+				_, cpErr := io.Copy(io.MultiWriter(fpStdErr, oh.stdErr), stdErrReader)
 				if cpErr != nil {
 					e.o.Debug("fpStdErr io.Copy: %s\n", cpErr)
 				}
 			}()
 		} else {
-			session.Stdout = &stdOut
-			session.Stderr = &stdErr
+			session.Stdout = io.MultiWriter(&stdOut, oh.stdOut)
+			session.Stderr = io.MultiWriter(&stdErr, oh.stdErr)
 		}
 		e.s.SetRunWaitState(me, stateStartSession)
 		if err = session.Start(req.cmd); err != nil {
-			done <- runResponse{err: err}
+			done <- runResponse{err: stageError(stageSession, err)}
 			return
 		}
 		e.s.SetRunWaitState(me, stateRunning)
@@ -119,19 +128,22 @@ func runCmd(me string, req runRequest, client *ssh.Client, e Env) {
 				e.o.Debug("Unknown exit code, faking it.\n")
 				exitCode = 255
 			}
+			err = stageError(stageRun, err)
 		}
-		if e.c.Spool {
-			_, err = fmt.Fprintf(fpRetCode, "%d\n", exitCode)
-			if err != nil {
-				e.o.Debug("fmt.Fprintf: %s\n", err)
+		// The output can still be on its way into the spool files.
+		copying.Wait()
+		if spool {
+			if _, retErr := fmt.Fprintf(fpRetCode, "%d\n", exitCode); retErr != nil {
+				e.o.Debug("fmt.Fprintf: %s\n", retErr)
 			}
 		}
 		e.s.SetRunWaitState(me, stateDone)
 		done <- runResponse{
-			stdOut:   stdOut.String(),
-			stdErr:   stdErr.String(),
-			err:      err,
-			exitCode: int(exitCode),
+			stdOut:    stdOut.String(),
+			stdErr:    stdErr.String(),
+			outputSum: oh.sum(),
+			err:       err,
+			exitCode:  int(exitCode),
 		}
 	}(runResp)
 	go sleep(timeoutChan, req.timeout)
@@ -144,9 +156,9 @@ func runCmd(me string, req runRequest, client *ssh.Client, e Env) {
 	case organic := <-timeoutChan:
 		var retErr error
 		if organic {
-			retErr = errors.New("Remote run timed out.")
+			retErr = kindError(kindTimeout, stageRun, errors.New("Remote run timed out."))
 		} else {
-			retErr = errors.New("Remote run aborted.")
+			retErr = kindError(kindAbort, stageRun, errors.New("Remote run aborted."))
 		}
 		// At this point it would be nice to terminate the running program.
 		// session.Signal() would be great for this, but it's not actually
@@ -167,7 +179,7 @@ func runCmd(me string, req runRequest, client *ssh.Client, e Env) {
 func runOnce(host string, cmd string, e Env, timeout int) {
 	startTime := time.Now()
 	mychan := make(chan runResponse)
-	req := runRequest{cmd, mychan, timeout}
+	req := runRequest{cmd, mychan, timeout, ""}
 	ci, err := e.s.GetConnInfo(host)
 	if err != nil {
 		e.o.Debug("GetConnInfo(): %s\n", err)
@@ -176,86 +188,102 @@ func runOnce(host string, cmd string, e Env, timeout int) {
 	ci.reqChan <- req
 	resp := <-mychan
 	elapsedTime := time.Since(startTime)
-	if resp.err != nil {
-		e.s.SetRunStatus(setRunStatus{host, false, true, elapsedTime, resp.err, ""})
-	} else {
-		srs := setRunStatus{host, true, true, elapsedTime, nil, resp.stdOut}
-		e.s.SetRunStatus(srs)
-	}
+	e.s.SetRunStatus(setRunStatus{
+		hostName:  host,
+		runOK:     resp.err == nil,
+		runOnce:   true,
+		runTime:   elapsedTime,
+		lastError: resp.err,
+		cmdOutput: resp.stdOut,
+		exitCode:  resp.exitCode,
+	})
 }
 
-// The runEverywhere function runs a command on every connected target.
-func runEverywhere(cmd string, e Env, timeout int) {
+// The runEverywhere function runs the command in ct on the given targets,
+// those of them that are connected anyway. The results go into the run
+// history under the given run ID.
+func runEverywhere(id int, ct *cmdTemplate, targets []string, e Env, timeout int) {
 	var wg sync.WaitGroup
+	spoolDir := ""
+	if e.c.Spool {
+		dir, err := newSpoolRun(e, id)
+		if err != nil {
+			e.o.Err("Can't spool run %d: %s\n", id, err)
+		} else {
+			spoolDir = dir
+		}
+	}
 	limiter := make(chan struct{}, e.c.Concurrency)
-	var hk = e.s.GetConnKeys()
-	for j := range hk {
-		host := hk[j]
-		ci, err := e.s.GetConnInfo(host)
+	var hosts []string
+	for j := range targets {
+		ci, err := e.s.GetConnInfo(targets[j])
 		if err != nil {
 			e.o.Debug("GetConnInfo(): %s\n", err)
 			continue
 		}
-		if ci.isProxy {
-			continue
+		if !ci.isProxy {
+			hosts = append(hosts, targets[j])
 		}
+	}
+	sort.Strings(hosts)
+	audit(e, auditEntry{
+		Event:   auditRunStart,
+		Remote:  ct.cmd,
+		RunID:   id,
+		Targets: hosts,
+	})
+	startTime := time.Now()
+	for j := range hosts {
+		host := hosts[j]
 		wg.Add(1)
 		limiter <- struct{}{}
-		go func(host string, command string) {
+		go func(host string) {
 			defer func() { wg.Done(); <-limiter }()
 			startTime := time.Now()
-			mychan := make(chan runResponse)
-			req := runRequest{command, mychan, timeout}
-			ci, err := e.s.GetConnInfo(host)
+			var resp runResponse
+			hi, err := e.s.GetHostInfo(host)
 			if err != nil {
-				e.o.Debug("GetConnInfo(): %s\n", err)
+				e.o.Debug("GetHostInfo(): %s\n", err)
 				return
 			}
-			ci.reqChan <- req
-			resp := <-mychan
+			command, err := ct.forHost(hi)
+			if err != nil {
+				resp.err = kindError(kindLocal, stageRun, err)
+			} else {
+				mychan := make(chan runResponse)
+				req := runRequest{command, mychan, timeout, spoolDir}
+				ci, err := e.s.GetConnInfo(host)
+				if err != nil {
+					e.o.Debug("GetConnInfo(): %s\n", err)
+					return
+				}
+				ci.reqChan <- req
+				resp = <-mychan
+			}
 			elapsedTime := time.Since(startTime)
 			e.s.SetRunStatus(setRunStatus{
-				host,
-				resp.err == nil,
-				true,
-				elapsedTime,
-				resp.err,
-				resp.stdOut,
+				hostName:  host,
+				runOK:     resp.err == nil,
+				runOnce:   true,
+				runTime:   elapsedTime,
+				lastError: resp.err,
+				cmdOutput: resp.stdOut,
+				runID:     id,
+				exitCode:  resp.exitCode,
+				outputSum: resp.outputSum,
 			})
 			if resp.stdOut != "" {
 				f := "***** Host: %s, Time: %.2fs, Exit: %d, Err: %v *****\n%s"
 				e.o.Out(f, host, elapsedTime.Seconds(), resp.exitCode, resp.err, resp.stdOut)
 			}
-		}(host, cmd)
+		}(host)
 	}
 	wg.Wait()
-}
-
-// Return open file handles for the spool files.
-func spoolHandles(e Env, hostName string) (*os.File, *os.File, *os.File, error) {
-	fpStdOut, err := os.Create(e.c.SpoolDir + "/" + hostName + ".out")
-	if err != nil {
-		return nil, nil, nil, err
-	}
-	fpStdErr, err := os.Create(e.c.SpoolDir + "/" + hostName + ".err")
-	if err != nil {
-		err = fpStdOut.Close()
-		if err != nil {
-			e.o.Debug("fpStdOut.Close(): %s\n", err)
-		}
-		return nil, nil, nil, err
-	}
-	fpRetCode, err := os.Create(e.c.SpoolDir + "/" + hostName + ".ret")
-	if err != nil {
-		err = fpStdOut.Close()
-		if err != nil {
-			e.o.Debug("fpStdOut.Close(): %s\n", err)
-		}
-		err = fpStdErr.Close()
-		if err != nil {
-			e.o.Debug("fpStdErr.Close(): %s\n", err)
+	e.s.FinishRun(id)
+	auditRun(e, id, time.Since(startTime))
+	if spoolDir != "" {
+		if err := writeManifest(e, spoolDir, id); err != nil {
+			e.o.Err("Can't write the manifest for run %d: %s\n", id, err)
 		}
-		return nil, nil, nil, err
 	}
-	return fpStdOut, fpStdErr, fpRetCode, nil
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The fakeSSHServer function starts an SSH server that lets anyone in and
+// runs "out|err" style commands by printing out to STDOUT and err to STDERR.
+// It returns a client that's logged into it.
+func fakeSSHServer(t *testing.T) *ssh.Client {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config)
+		}
+	}()
+	client, err := ssh.Dial("tcp", l.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range chReqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				out := strings.SplitN(exec.Command+"|", "|", 3)
+				ch.Write([]byte(out[0]))
+				ch.Stderr().Write([]byte(out[1]))
+				ch.CloseWrite()
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				ch.Close()
+			}
+		}()
+	}
+}
+
+func TestRunSpooledOutputSum(t *testing.T) {
+	client := fakeSSHServer(t)
+	e, _ := testEnv()
+	e.c.Spool = true
+	spoolDir := t.TempDir()
+	run := func(cmd string) runResponse {
+		resp := make(chan runResponse)
+		go runCmd("web-1", runRequest{cmd, resp, 5, spoolDir}, client, e)
+		return <-resp
+	}
+	tests := []struct {
+		name string
+		cmd  string
+		same bool // As the output of the first
+	}{
+		{"first", "hello|", true},
+		{"same again", "hello|", true},
+		{"different stdout", "goodbye|", false},
+		{"same stdout, different stderr", "hello|oops", false},
+		{"moved between the two", "|hello", false},
+	}
+	var first string
+	for i, tt := range tests {
+		resp := run(tt.cmd)
+		if resp.err != nil {
+			t.Fatalf("%s: %s", tt.name, resp.err)
+		}
+		// Without --tee, the output only goes to the spool.
+		if resp.stdOut != "" || resp.stdErr != "" {
+			t.Errorf("%s: got output %q %q without --tee", tt.name, resp.stdOut, resp.stdErr)
+		}
+		parts := strings.SplitN(tt.cmd, "|", 2)
+		for j, ext := range []string{".out", ".err"} {
+			buf, err := ioutil.ReadFile(filepath.Join(spoolDir, "web-1"+ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != parts[j] {
+				t.Errorf("%s: spooled %q to %s, want %q", tt.name, buf, ext, parts[j])
+			}
+		}
+		if i == 0 {
+			first = resp.outputSum
+		}
+		if (resp.outputSum == first) != tt.same {
+			t.Errorf("%s: got sum %s, first was %s, want same %v", tt.name, resp.outputSum, first, tt.same)
+		}
+	}
+	// A run that isn't spooled sums up the same output the same way.
+	resp := make(chan runResponse)
+	go runCmd("web-1", runRequest{"hello|", resp, 5, ""}, client, e)
+	if r := <-resp; r.stdOut != "hello" || r.outputSum != first {
+		t.Errorf("unspooled: got %q with sum %s, want %q with %s", r.stdOut, r.outputSum, "hello", first)
+	}
+}
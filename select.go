@@ -0,0 +1,458 @@
+/*
+ * select.go
+ *
+ * The select and exclude commands narrow down which of the targets a run
+ * goes to, without disconnecting the rest. They take expressions over what
+ * we know about each host, like:
+ *
+ *	select name~'^db-' and connected and exit!=0
+ *	exclude web-1* or kind=timeout
+ *
+ * A term is a field compared to a value, a boolean field on its own, or just
+ * a glob, which is matched against the host name. Strings compare with = and
+ * != as globs, with ~ and !~ as regular expressions. Numbers take the usual
+ * = != < <= > >=. Terms combine with and, or, not and parentheses. A tag
+ * term matches if any of the host's tags do, and any field we don't know
+ * about is looked up in the host's meta, so dc=sjc1 and rack>10 work.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A hostPred tells us whether a host matches an expression.
+type hostPred func(HostInfo) bool
+
+// The string fields we can match on.
+var stringFields = map[string]func(HostInfo) string{
+	"name": func(hi HostInfo) string { return hi.hostName },
+	"ip":   func(hi HostInfo) string { return hi.ipAddress },
+	"chain": func(hi HostInfo) string {
+		return strings.Join(hi.chain, " ")
+	},
+	"error": func(hi HostInfo) string {
+		if hi.lastError == nil {
+			return ""
+		}
+		return hi.lastError.Error()
+	},
+	"kind": func(hi HostInfo) string {
+		if hi.lastError == nil {
+			return ""
+		}
+		return errorClass(hi.lastError)
+	},
+	"stage": func(hi HostInfo) string { return errorStage(hi.lastError) },
+}
+
+// The fields that have a list of values, a term on one matches if any of
+// the values do.
+var listFields = map[string]func(HostInfo) []string{
+	"tag": func(hi HostInfo) []string { return hi.tags },
+}
+
+// The number fields we can compare.
+var numberFields = map[string]func(HostInfo) float64{
+	"exit":        func(hi HostInfo) float64 { return float64(hostExitCode(hi)) },
+	"connecttime": func(hi HostInfo) float64 { return hi.connectTime.Seconds() },
+	"runtime":     func(hi HostInfo) float64 { return hi.runTime.Seconds() },
+	"attempts":    func(hi HostInfo) float64 { return float64(len(hi.attempts)) },
+}
+
+// The boolean fields, which can stand on their own as a term.
+var boolFields = map[string]func(HostInfo) bool{
+	"connected":  func(hi HostInfo) bool { return hi.connectedOK },
+	"ran":        func(hi HostInfo) bool { return hi.runOnce },
+	"ok":         func(hi HostInfo) bool { return hi.runOnce && hi.runOK },
+	"failed":     func(hi HostInfo) bool { return hi.runOnce && !hi.runOK },
+	"requirespw": func(hi HostInfo) bool { return hi.requiresPw },
+	"retried":    func(hi HostInfo) bool { return len(hi.attempts) > 1 },
+}
+
+// The hostExitCode function returns the exit code of the last thing run on
+// a host, or -1 if it never ran or didn't get as far as exiting.
+func hostExitCode(hi HostInfo) int {
+	switch {
+	case !hi.runOnce:
+		return -1
+	case hi.runOK:
+		return 0
+	case errorClass(hi.lastError) == kindExit:
+		return hi.exitCode
+	}
+	return -1
+}
+
+const (
+	tokWord = iota
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind int
+	text string
+}
+
+func isOpChar(r rune) bool {
+	return strings.ContainsRune("=!~<>", r)
+}
+
+// The lexSelect function chops an expression up into tokens.
+func lexSelect(expr string) ([]token, error) {
+	var toks []token
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			toks = append(toks, token{tokLParen, "("})
+			i++
+		case r == ')':
+			toks = append(toks, token{tokRParen, ")"})
+			i++
+		case r == '\'' || r == '"':
+			j := i + 1
+			for j < len(runes) && runes[j] != r {
+				j++
+			}
+			if j == len(runes) {
+				return nil, errors.New("Unterminated string in expression.")
+			}
+			toks = append(toks, token{tokString, string(runes[i+1 : j])})
+			i = j + 1
+		case isOpChar(r):
+			j := i + 1
+			for j < len(runes) && isOpChar(runes[j]) {
+				j++
+			}
+			toks = append(toks, token{tokOp, string(runes[i:j])})
+			i = j
+		default:
+			j := i + 1
+			for j < len(runes) && !unicode.IsSpace(runes[j]) &&
+				!isOpChar(runes[j]) && !strings.ContainsRune("()'\"", runes[j]) {
+				j++
+			}
+			toks = append(toks, token{tokWord, string(runes[i:j])})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+type selectParser struct {
+	toks []token
+	pos  int
+}
+
+// The parseSelect function turns an expression into a hostPred.
+func parseSelect(expr string) (hostPred, error) {
+	toks, err := lexSelect(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, errors.New("Empty expression.")
+	}
+	p := &selectParser{toks: toks}
+	pred, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, errors.New("Unexpected '" + p.toks[p.pos].text + "' in expression.")
+	}
+	return pred, nil
+}
+
+func (p *selectParser) peek() (token, bool) {
+	if p.pos >= len(p.toks) {
+		return token{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+// The keyword method eats the next token if it's one of words.
+func (p *selectParser) keyword(words ...string) bool {
+	t, ok := p.peek()
+	if !ok || (t.kind != tokWord && t.kind != tokOp) {
+		return false
+	}
+	for i := range words {
+		if strings.ToLower(t.text) == words[i] {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *selectParser) or() (hostPred, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or", "||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(hi HostInfo) bool { return l(hi) || right(hi) }
+	}
+	return left, nil
+}
+
+func (p *selectParser) and() (hostPred, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and", "&&") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(hi HostInfo) bool { return l(hi) && right(hi) }
+	}
+	return left, nil
+}
+
+func (p *selectParser) not() (hostPred, error) {
+	if p.keyword("not", "!") {
+		pred, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(hi HostInfo) bool { return !pred(hi) }, nil
+	}
+	return p.primary()
+}
+
+func (p *selectParser) primary() (hostPred, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, errors.New("Expression ends too soon.")
+	}
+	switch t.kind {
+	case tokLParen:
+		p.pos++
+		pred, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok = p.peek(); !ok || t.kind != tokRParen {
+			return nil, errors.New("Missing ')' in expression.")
+		}
+		p.pos++
+		return pred, nil
+	case tokString:
+		p.pos++
+		return globPred(stringFields["name"], t.text, false)
+	case tokWord:
+		p.pos++
+		return p.term(t.text)
+	}
+	return nil, errors.New("Unexpected '" + t.text + "' in expression.")
+}
+
+// The term method parses what comes after a word: a comparison if the word
+// is a field and an operator follows, otherwise a boolean field or a glob.
+func (p *selectParser) term(word string) (hostPred, error) {
+	field := strings.ToLower(word)
+	op, ok := p.peek()
+	if !ok || op.kind != tokOp || op.text == "!" {
+		if f, exists := boolFields[field]; exists {
+			return hostPred(f), nil
+		}
+		return globPred(stringFields["name"], word, false)
+	}
+	p.pos++
+	val, ok := p.peek()
+	if !ok || (val.kind != tokWord && val.kind != tokString) {
+		return nil, errors.New("Missing a value after '" + word + op.text + "'.")
+	}
+	p.pos++
+	if f, exists := listFields[field]; exists {
+		return listPred(f, field, op.text, val.text)
+	}
+	if f, exists := stringFields[field]; exists {
+		return stringPred(f, field, op.text, val.text)
+	}
+	if f, exists := numberFields[field]; exists {
+		return numberPred(f, op.text, val.text)
+	}
+	if f, exists := boolFields[field]; exists {
+		want, err := strconv.ParseBool(val.text)
+		if err != nil {
+			return nil, errors.New("Expected true or false for " + field + ".")
+		}
+		switch op.text {
+		case "=", "==":
+			return func(hi HostInfo) bool { return f(hi) == want }, nil
+		case "!=":
+			return func(hi HostInfo) bool { return f(hi) != want }, nil
+		}
+		return nil, errors.New("Can't use '" + op.text + "' on " + field + ".")
+	}
+	// Anything else is a meta key, which we don't lower case since the
+	// targets can call them what they like.
+	meta := func(hi HostInfo) string { return hi.meta[word] }
+	switch op.text {
+	case "<", "<=", ">", ">=":
+		return numberPred(func(hi HostInfo) float64 {
+			n, err := strconv.ParseFloat(meta(hi), 64)
+			if err != nil {
+				return math.NaN()
+			}
+			return n
+		}, op.text, val.text)
+	}
+	return stringPred(meta, word, op.text, val.text)
+}
+
+func stringPred(f func(HostInfo) string, field, op, value string) (hostPred, error) {
+	switch op {
+	case "=", "==":
+		return globPred(f, value, false)
+	case "!=":
+		return globPred(f, value, true)
+	case "~":
+		return regexPred(f, value, false)
+	case "!~":
+		return regexPred(f, value, true)
+	}
+	return nil, errors.New("Can't use '" + op + "' on " + field + ".")
+}
+
+// The listPred function matches if any of the values do, or for != and !~,
+// if none of them do.
+func listPred(f func(HostInfo) []string, field, op, value string) (hostPred, error) {
+	var match func(string) bool
+	switch op {
+	case "=", "==", "!=":
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, errors.New("Bad glob '" + value + "': " + err.Error())
+		}
+		match = func(s string) bool {
+			ok, _ := path.Match(value, s)
+			return ok
+		}
+	case "~", "!~":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, err
+		}
+		match = re.MatchString
+	default:
+		return nil, errors.New("Can't use '" + op + "' on " + field + ".")
+	}
+	negate := strings.HasPrefix(op, "!")
+	return func(hi HostInfo) bool {
+		values := f(hi)
+		for i := range values {
+			if match(values[i]) {
+				return !negate
+			}
+		}
+		return negate
+	}, nil
+}
+
+func globPred(f func(HostInfo) string, pattern string, negate bool) (hostPred, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errors.New("Bad glob '" + pattern + "': " + err.Error())
+	}
+	return func(hi HostInfo) bool {
+		ok, _ := path.Match(pattern, f(hi))
+		return ok != negate
+	}, nil
+}
+
+func regexPred(f func(HostInfo) string, pattern string, negate bool) (hostPred, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(hi HostInfo) bool {
+		return re.MatchString(f(hi)) != negate
+	}, nil
+}
+
+func numberPred(f func(HostInfo) float64, op, value string) (hostPred, error) {
+	want, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, errors.New("Expected a number, not '" + value + "'.")
+	}
+	var cmp func(a, b float64) bool
+	switch op {
+	case "=", "==":
+		cmp = func(a, b float64) bool { return a == b }
+	case "!=":
+		cmp = func(a, b float64) bool { return a != b }
+	case "<":
+		cmp = func(a, b float64) bool { return a < b }
+	case "<=":
+		cmp = func(a, b float64) bool { return a <= b }
+	case ">":
+		cmp = func(a, b float64) bool { return a > b }
+	case ">=":
+		cmp = func(a, b float64) bool { return a >= b }
+	default:
+		return nil, errors.New("Unknown operator '" + op + "'.")
+	}
+	return func(hi HostInfo) bool { return cmp(f(hi), want) }, nil
+}
+
+// The matchingHosts function returns the hosts out of hosts that pred
+// matches. Matching nothing gives an empty list, not nil, since a nil
+// selection means everything.
+func matchingHosts(e Env, hosts []string, pred hostPred) []string {
+	matched := []string{}
+	for i := range hosts {
+		hi, err := e.s.GetHostInfo(hosts[i])
+		if err != nil {
+			e.o.Debug("GetHostInfo(): %s\n", err)
+			continue
+		}
+		if pred(hi) {
+			matched = append(matched, hosts[i])
+		}
+	}
+	return matched
+}
+
+// The selectedHosts function returns the hosts out of hosts that are
+// selected. With no selection, that's all of them.
+func selectedHosts(e Env, hosts []string) []string {
+	sel := e.s.GetSelection()
+	if sel == nil {
+		return hosts
+	}
+	in := make(map[string]bool, len(sel))
+	for i := range sel {
+		in[sel[i]] = true
+	}
+	var picked []string
+	for i := range hosts {
+		if in[hosts[i]] {
+			picked = append(picked, hosts[i])
+		}
+	}
+	return picked
+}
@@ -49,7 +49,7 @@ func (s *SSHServer) Start() {
 	s.e.o.Debug("Listening on the server port.\n")
 	listener, err := net.Listen("tcp", "0.0.0.0:"+ServerPort)
 	if err != nil {
-		s.e.o.ErrExit("Failed to listen on port %s: \n", ServerPort, err)
+		s.e.o.ErrExit("Failed to listen on port %s: %s\n", ServerPort, err)
 	}
 	for {
 		tcpConn, err := listener.Accept()
@@ -63,8 +63,15 @@ func (s *SSHServer) Start() {
 			continue
 		}
 		s.e.o.Debug("Client connection from: %s\n", sshConn.RemoteAddr())
+		who := &auditClient{
+			Addr: sshConn.RemoteAddr().String(),
+			User: sshConn.User(),
+		}
+		if sshConn.Permissions != nil {
+			who.Fingerprint = sshConn.Permissions.Extensions[FingerprintExt]
+		}
 		go s.discardRequests(reqs)
-		go s.handleChannels(chans)
+		go s.handleChannels(chans, who)
 	}
 }
 
@@ -79,13 +86,13 @@ func (s *SSHServer) discardRequests(in <-chan *ssh.Request) {
 	}
 }
 
-func (s *SSHServer) handleChannels(chans <-chan ssh.NewChannel) {
+func (s *SSHServer) handleChannels(chans <-chan ssh.NewChannel, who *auditClient) {
 	for newChannel := range chans {
-		go s.handleChannel(newChannel)
+		go s.handleChannel(newChannel, who)
 	}
 }
 
-func (s *SSHServer) handleChannel(newChannel ssh.NewChannel) {
+func (s *SSHServer) handleChannel(newChannel ssh.NewChannel, who *auditClient) {
 	var tty, xpty *os.File
 	var err error
 	var con ssh.Channel
@@ -106,15 +113,19 @@ func (s *SSHServer) handleChannel(newChannel ssh.NewChannel) {
 		return
 	}
 	newOut := NewOutput(con, con, true, s.e.c.Debug)
-	newE := Env{s.e.s, newOut, s.e.c}
+	newE := s.e
+	newE.o = newOut
+	newE.who = who
 	for req := range requests {
 		switch req.Type {
 		case "exec":
 			payload, _ := pullUint32(req.Payload)
 			cmdline := string(payload)
 			chunks := strings.Fields(cmdline)
-			cmd := strings.ToLower(chunks[0])
-			runCliCmd(newE, cmd, chunks[1:])
+			if len(chunks) > 0 {
+				cmd := strings.ToLower(chunks[0])
+				runCliCmd(withVia(newE, "exec"), cmd, chunks[1:])
+			}
 			if err = con.Close(); err != nil {
 				s.e.o.Debug("con.Close() faied: %s\n", err)
 			}
@@ -124,10 +135,10 @@ func (s *SSHServer) handleChannel(newChannel ssh.NewChannel) {
 				s.readlineSession = true
 				go func() {
 					defer func() { s.readlineSession = false }()
-					cli(con, newE, true)
+					cli(con, withVia(newE, "shell"), true)
 				}()
 			} else {
-				cli(con, newE, false)
+				cli(con, withVia(newE, "shell"), false)
 			}
 		case "pty-req":
 			termLen := req.Payload[3]
@@ -52,6 +52,11 @@ func handleSignals(e Env) {
 
 func cleanDeath(deathChan chan os.Signal, e Env) {
 	for range deathChan {
+		if e.c.Server && e.c.StateFile != "" && len(e.s.GetHostKeys()) > 0 {
+			if _, err := saveState(e, e.c.StateFile); err != nil {
+				e.o.Err("Can't save state to %s: %s\n", e.c.StateFile, err)
+			}
+		}
 		disconnectEverywhere(e, true)
 		e.o.Debug("Cya.\n")
 		os.Exit(0)
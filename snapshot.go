@@ -0,0 +1,183 @@
+/*
+ * snapshot.go
+ *
+ * Reconnecting thousands of hosts after a restart takes minutes, and until now
+ * everything we knew about the targets went away with the daemon. This file
+ * saves the targets, the PTR map and the last connect/run results to a JSON
+ * snapshot, on shutdown and with the save command, and --restore loads it
+ * back up again.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SnapshotVersion gets bumped whenever the snapshot format changes in a way
+// that older code can't read.
+const SnapshotVersion = 1
+
+// snapshot is what gets written to the state file.
+type snapshot struct {
+	Version int               `json:"version"`
+	Saved   time.Time         `json:"saved"`
+	Hosts   []snapshotHost    `json:"hosts"`
+	PTR     map[string]string `json:"ptr"`
+}
+
+// snapshotHost is the part of HostInfo worth keeping around.
+type snapshotHost struct {
+	Name        string            `json:"name"`
+	IPAddress   string            `json:"ip_address"`
+	Chain       []string          `json:"chain"`
+	RequiresPw  bool              `json:"requires_pw,omitempty"`
+	ConnectedOK bool              `json:"connected_ok"`
+	ConnectTime time.Duration     `json:"connect_time"`
+	RunTime     time.Duration     `json:"run_time,omitempty"`
+	RunOK       bool              `json:"run_ok,omitempty"`
+	RunOnce     bool              `json:"run_once,omitempty"`
+	LastError   string            `json:"last_error,omitempty"`
+	ErrorKind   string            `json:"error_kind,omitempty"`
+	ErrorStage  string            `json:"error_stage,omitempty"`
+	ExitCode    int               `json:"exit_code,omitempty"`
+	User        string            `json:"user,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+// The saveState function writes a snapshot of the targets to path. It goes
+// to a temporary file first, so a crash halfway through doesn't leave us
+// with half a snapshot.
+func saveState(e Env, path string) (int, error) {
+	snap := snapshot{
+		Version: SnapshotVersion,
+		Saved:   time.Now(),
+		PTR:     e.s.GetPTRs(),
+	}
+	hk := e.s.GetHostKeys()
+	for i := range hk {
+		hi, err := e.s.GetHostInfo(hk[i])
+		if err != nil {
+			continue
+		}
+		sh := snapshotHost{
+			Name:        hi.hostName,
+			IPAddress:   hi.ipAddress,
+			Chain:       hi.chain,
+			RequiresPw:  hi.requiresPw,
+			ConnectedOK: hi.connectedOK,
+			ConnectTime: hi.connectTime,
+			RunTime:     hi.runTime,
+			RunOK:       hi.runOK,
+			RunOnce:     hi.runOnce,
+			ExitCode:    hi.exitCode,
+			User:        hi.user,
+			Tags:        hi.tags,
+			Meta:        hi.meta,
+		}
+		if hi.lastError != nil {
+			sh.LastError = hi.lastError.Error()
+			if oe, ok := hi.lastError.(*opError); ok {
+				sh.ErrorKind = oe.kind
+				sh.ErrorStage = oe.stage
+			}
+		}
+		snap.Hosts = append(snap.Hosts, sh)
+	}
+	blob, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".metassh-state")
+	if err != nil {
+		return 0, err
+	}
+	if _, err = tmp.Write(blob); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return len(snap.Hosts), nil
+}
+
+// The restoreState function loads the targets from a snapshot written by
+// saveState. Hosts that are already targeted are left alone. Nothing is
+// connected after a restore, so connectedOK starts out false, but the other
+// results are kept for the summary.
+func restoreState(e Env, path string) (int, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var snap snapshot
+	if err = json.Unmarshal(blob, &snap); err != nil {
+		return 0, err
+	}
+	if snap.Version != SnapshotVersion {
+		msg := fmt.Sprintf("Snapshot version %d, expected %d.", snap.Version, SnapshotVersion)
+		return 0, errors.New(msg)
+	}
+	for ip, host := range snap.PTR {
+		e.s.SetPTR(ip, host)
+	}
+	count := 0
+	for i := range snap.Hosts {
+		sh := snap.Hosts[i]
+		if len(sh.Chain) == 0 {
+			e.o.Debug("Snapshot entry for %s has no chain.\n", sh.Name)
+			continue
+		}
+		if e.s.HostExists(sh.Name) {
+			e.o.Debug("Duplicate HostInfo entry for: %s\n", sh.Name)
+			continue
+		}
+		hi := HostInfo{
+			hostName:    sh.Name,
+			ipAddress:   sh.IPAddress,
+			chain:       sh.Chain,
+			requiresPw:  sh.RequiresPw,
+			connectTime: sh.ConnectTime,
+			runTime:     sh.RunTime,
+			runOK:       sh.RunOK,
+			runOnce:     sh.RunOnce,
+			exitCode:    sh.ExitCode,
+			user:        sh.User,
+			tags:        sh.Tags,
+			meta:        sh.Meta,
+		}
+		// The error goes back to being the kind it was, so the summary
+		// groups it the same way.
+		switch {
+		case sh.LastError == "":
+		case sh.ErrorKind != "":
+			hi.lastError = kindError(sh.ErrorKind, sh.ErrorStage, errors.New(sh.LastError))
+		default:
+			hi.lastError = errors.New(sh.LastError)
+		}
+		e.s.SetHostInfo(hi)
+		count++
+	}
+	e.o.Debug(
+		"Restored %d hosts from %s, saved %.0fs ago.\n",
+		count,
+		path,
+		time.Since(snap.Saved).Seconds(),
+	)
+	return count, nil
+}
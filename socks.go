@@ -0,0 +1,217 @@
+/*
+ * socks.go
+ *
+ * This file has a tiny SOCKS5 server that lets browsers and curl reach
+ * services inside the fleet. We already hold SSH connections to the bastions
+ * and targets, so a SOCKS connection to hostname:port gets turned into a
+ * direct-tcpip channel on the matching connection: the host itself if we are
+ * connected to it, otherwise the bastion right in front of it in its chain.
+ *
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 reply codes we send back, from RFC 1928.
+const (
+	socks5Succeeded          = 0x00
+	socks5HostUnreachable    = 0x04
+	socks5ConnRefused        = 0x05
+	socks5CmdNotSupported    = 0x07
+	socks5AddrNotSupported   = 0x08
+	socks5ReplyHeaderAndAddr = 10
+)
+
+// The serveSocks function listens on the --socks-listen address and hands
+// every client off to handleSocks.
+func serveSocks(e Env) {
+	l, err := net.Listen("tcp", e.c.SocksListen)
+	if err != nil {
+		e.o.ErrExit("Failed to listen on %s: %s\n", e.c.SocksListen, err)
+	}
+	e.o.Debug("SOCKS5 proxy listening on %s\n", e.c.SocksListen)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			e.o.Err("Failed to accept SOCKS connection: %s\n", err)
+			continue
+		}
+		go handleSocks(e, conn)
+	}
+}
+
+func handleSocks(e Env, conn net.Conn) {
+	defer func() {
+		if err := conn.Close(); err != nil {
+			e.o.Debug("conn.Close(): %s\n", err)
+		}
+	}()
+	host, port, err := socksHandshake(conn)
+	if err != nil {
+		e.o.Debug("SOCKS handshake from %s: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	via, addr, err := socksRoute(e, host, port)
+	if err != nil {
+		e.o.Debug("SOCKS: %s\n", err)
+		socksReply(e, conn, socks5HostUnreachable)
+		return
+	}
+	ci, err := e.s.GetConnInfo(via)
+	if err != nil {
+		e.o.Debug("GetConnInfo(): %s\n", err)
+		socksReply(e, conn, socks5HostUnreachable)
+		return
+	}
+	e.o.Debug("SOCKS: %s:%s via %s as %s\n", host, port, via, addr)
+	respChan := make(chan dialResponse)
+	ci.reqChan <- dialRequest{addr, respChan}
+	resp := <-respChan
+	if resp.err != nil {
+		e.o.Debug("SOCKS: dial %s via %s: %s\n", addr, via, resp.err)
+		socksReply(e, conn, socks5ConnRefused)
+		return
+	}
+	defer func() {
+		if err := resp.conn.Close(); err != nil {
+			e.o.Debug("remote.Close(): %s\n", err)
+		}
+	}()
+	if !socksReply(e, conn, socks5Succeeded) {
+		return
+	}
+	done := make(chan bool, 2)
+	go func() {
+		_, _ = io.Copy(resp.conn, conn)
+		done <- true
+	}()
+	go func() {
+		_, _ = io.Copy(conn, resp.conn)
+		done <- true
+	}()
+	// Once either side hangs up we're done, the deferred closes will
+	// knock the other copy loose.
+	<-done
+}
+
+// The socksHandshake function does the server side of the SOCKS5 greeting
+// and reads a CONNECT request. We only offer "no authentication", so you'll
+// want to keep --socks-listen on a loopback address.
+func socksHandshake(conn net.Conn) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socks5Version {
+		return "", "", errors.New("unsupported SOCKS version " + strconv.Itoa(int(header[0])))
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", err
+	}
+	noAuth := false
+	for i := range methods {
+		if methods[i] == socks5AuthNone {
+			noAuth = true
+		}
+	}
+	if !noAuth {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return "", "", errors.New("client doesn't do unauthenticated SOCKS")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5AuthNone}); err != nil {
+		return "", "", err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return "", "", err
+	}
+	if req[1] != socks5Connect {
+		_, _ = conn.Write(socksReplyMsg(socks5CmdNotSupported))
+		return "", "", errors.New("only CONNECT is supported")
+	}
+	var host string
+	switch req[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", "", err
+		}
+		host = string(name)
+	default:
+		_, _ = conn.Write(socksReplyMsg(socks5AddrNotSupported))
+		return "", "", errors.New("unknown address type")
+	}
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBuf); err != nil {
+		return "", "", err
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(portBuf)))
+	return host, port, nil
+}
+
+// The socksRoute function uses the chain in HostInfo to figure out which of
+// our connections can reach host, and what address to ask it to dial. That's
+// the host's own connection if we have one, otherwise the bastion right in
+// front of it.
+func socksRoute(e Env, host, port string) (string, string, error) {
+	name := e.s.GetPTR(host)
+	hi, err := e.s.GetHostInfo(name)
+	if err != nil {
+		// Not a target, but maybe it's a bastion.
+		if e.s.ConnExists(name) {
+			linkHost, _ := splitLink(host)
+			return name, net.JoinHostPort(linkHost, port), nil
+		}
+		return "", "", errors.New("no route to " + host)
+	}
+	last := len(hi.chain) - 1
+	linkHost, _ := splitLink(hi.chain[last])
+	addr := net.JoinHostPort(linkHost, port)
+	if e.s.ConnExists(name) {
+		return name, addr, nil
+	}
+	if last > 0 {
+		if proxy := e.s.GetPTR(hi.chain[last-1]); e.s.ConnExists(proxy) {
+			return proxy, addr, nil
+		}
+	}
+	return "", "", errors.New("no connected route to " + host)
+}
+
+func socksReplyMsg(code byte) []byte {
+	msg := make([]byte, socks5ReplyHeaderAndAddr)
+	msg[0] = socks5Version
+	msg[1] = code
+	msg[3] = socks5AddrIPv4
+	return msg
+}
+
+func socksReply(e Env, conn net.Conn, code byte) bool {
+	if _, err := conn.Write(socksReplyMsg(code)); err != nil {
+		e.o.Debug("SOCKS reply: %s\n", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+/*
+ * spool.go
+ *
+ * When spooling, every run gets its own directory under the SpoolDir, named
+ * after when it started and its run ID, like 20240131-142501-7. The output of
+ * each host goes in there as <host>.out, <host>.err and <host>.ret, and once
+ * the run is done we add a manifest.json saying what ran, when, and how it
+ * went on every host. A 'latest' symlink points at the newest run, and with
+ * --spoolkeep only that many run directories are kept around. Which ones are
+ * newest goes by when the manifest says they started, and runs that are still
+ * going are left alone.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The names of things in the SpoolDir.
+const (
+	SpoolManifest = "manifest.json"
+	SpoolLatest   = "latest"
+)
+
+var spoolRunDir = regexp.MustCompile(`^\d{8}-\d{6}-(\d+)$`)
+
+type spoolManifest struct {
+	ID       int                 `json:"id"`
+	Command  string              `json:"command"`
+	Started  time.Time           `json:"started"`
+	Finished time.Time           `json:"finished"`
+	Seconds  float64             `json:"seconds"`
+	Hosts    []spoolManifestHost `json:"hosts"`
+}
+
+type spoolManifestHost struct {
+	Host     string            `json:"host"`
+	OK       bool              `json:"ok"`
+	ExitCode int               `json:"exit_code"`
+	Seconds  float64           `json:"seconds"`
+	Error    string            `json:"error,omitempty"`
+	Kind     string            `json:"error_kind,omitempty"`
+	Stage    string            `json:"error_stage,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+}
+
+// The newSpoolRun function makes the spool directory for a run, points the
+// latest symlink at it, and prunes old runs if we're keeping a limited
+// number of them.
+func newSpoolRun(e Env, id int) (string, error) {
+	name := time.Now().Format("20060102-150405") + "-" + strconv.Itoa(id)
+	dir := filepath.Join(e.c.SpoolDir, name)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	// Swap the symlink in with a rename, so it's never missing.
+	tmp := filepath.Join(e.c.SpoolDir, "."+SpoolLatest+"-"+strconv.Itoa(id))
+	if err := os.Symlink(name, tmp); err != nil {
+		e.o.Debug("Symlink(): %s\n", err)
+	} else if err = os.Rename(tmp, filepath.Join(e.c.SpoolDir, SpoolLatest)); err != nil {
+		e.o.Debug("Rename(): %s\n", err)
+		os.Remove(tmp)
+	}
+	if e.c.SpoolKeep > 0 {
+		pruneSpool(e, e.c.SpoolKeep)
+	}
+	return dir, nil
+}
+
+// A spoolRun is a run directory in the SpoolDir.
+type spoolRun struct {
+	name    string
+	id      int
+	started time.Time
+}
+
+// The pruneSpool function removes all but the newest keep run directories.
+// Only directories that look like ours are touched, and not those of runs
+// that are still writing to them.
+func pruneSpool(e Env, keep int) {
+	entries, err := ioutil.ReadDir(e.c.SpoolDir)
+	if err != nil {
+		e.o.Debug("ReadDir(): %s\n", err)
+		return
+	}
+	var runs []spoolRun
+	for i := range entries {
+		m := spoolRunDir.FindStringSubmatch(entries[i].Name())
+		if !entries[i].IsDir() || m == nil {
+			continue
+		}
+		id, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		runs = append(runs, spoolRun{
+			name:    m[0],
+			id:      id,
+			started: spoolStarted(filepath.Join(e.c.SpoolDir, m[0]), entries[i].ModTime()),
+		})
+	}
+	if len(runs) <= keep {
+		return
+	}
+	going := make(map[int]bool)
+	history := e.s.GetRuns()
+	for i := range history {
+		if history[i].finished.IsZero() {
+			going[history[i].id] = true
+		}
+	}
+	sort.Slice(runs, func(a, b int) bool {
+		return runs[a].started.Before(runs[b].started)
+	})
+	for _, run := range runs[:len(runs)-keep] {
+		if going[run.id] {
+			e.o.Debug("Not pruning spool run %s, it's still going.\n", run.name)
+			continue
+		}
+		e.o.Debug("Pruning spool run %s\n", run.name)
+		if err := os.RemoveAll(filepath.Join(e.c.SpoolDir, run.name)); err != nil {
+			e.o.Debug("RemoveAll(): %s\n", err)
+		}
+	}
+}
+
+// The spoolStarted function returns when the run in dir started, going by
+// its manifest. Runs without one, because they're still going or never
+// finished, go by modTime instead.
+func spoolStarted(dir string, modTime time.Time) time.Time {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, SpoolManifest))
+	if err != nil {
+		return modTime
+	}
+	var m spoolManifest
+	if err := json.Unmarshal(blob, &m); err != nil || m.Started.IsZero() {
+		return modTime
+	}
+	return m.Started
+}
+
+// The writeManifest function writes manifest.json for a finished run, from
+// what the run history has on it.
+func writeManifest(e Env, dir string, id int) error {
+	rr, err := e.s.GetRun(id)
+	if err != nil {
+		return err
+	}
+	m := spoolManifest{
+		ID:       rr.id,
+		Command:  rr.cmd,
+		Started:  rr.started,
+		Finished: rr.finished,
+		Seconds:  rr.finished.Sub(rr.started).Seconds(),
+	}
+	hosts := sortedRunHosts(rr)
+	for i := range hosts {
+		res := rr.results[hosts[i]]
+		mh := spoolManifestHost{
+			Host:     hosts[i],
+			OK:       res.ok,
+			ExitCode: res.exitCode,
+			Seconds:  res.runTime.Seconds(),
+		}
+		if hi, err := e.s.GetHostInfo(hosts[i]); err == nil {
+			mh.Tags = hi.tags
+			mh.Meta = hi.meta
+		}
+		if res.err != nil {
+			mh.Error = res.err.Error()
+			mh.Kind = errorClass(res.err)
+			mh.Stage = errorStage(res.err)
+		}
+		m.Hosts = append(m.Hosts, mh)
+	}
+	blob, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, SpoolManifest), blob, 0644)
+}
+
+// Return open file handles for the spool files.
+func spoolHandles(e Env, dir, hostName string) (*os.File, *os.File, *os.File, error) {
+	base := filepath.Join(dir, hostName)
+	fpStdOut, err := os.Create(base + ".out")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fpStdErr, err := os.Create(base + ".err")
+	if err != nil {
+		if cErr := fpStdOut.Close(); cErr != nil {
+			e.o.Debug("fpStdOut.Close(): %s\n", cErr)
+		}
+		return nil, nil, nil, err
+	}
+	fpRetCode, err := os.Create(base + ".ret")
+	if err != nil {
+		if cErr := fpStdOut.Close(); cErr != nil {
+			e.o.Debug("fpStdOut.Close(): %s\n", cErr)
+		}
+		if cErr := fpStdErr.Close(); cErr != nil {
+			e.o.Debug("fpStdErr.Close(): %s\n", cErr)
+		}
+		return nil, nil, nil, err
+	}
+	return fpStdOut, fpStdErr, fpRetCode, nil
+}
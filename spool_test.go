@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPruneSpool(t *testing.T) {
+	e, _ := testEnv()
+	e.c.SpoolDir = t.TempDir()
+	// Runs 1 and 2 are done, 3 is still going.
+	for i := 0; i < 3; i++ {
+		e.s.StartRun("uptime")
+	}
+	e.s.FinishRun(1)
+	e.s.FinishRun(2)
+
+	day := func(d int) time.Time {
+		return time.Date(2024, time.January, d, 0, 0, 0, 0, time.UTC)
+	}
+	dirs := []struct {
+		name     string
+		manifest time.Time // Zero for no manifest
+		modTime  time.Time
+	}{
+		// The names say otherwise, but this is the newest.
+		{"20240101-000000-1", day(5), day(1)},
+		{"20240102-000000-2", day(2), day(2)},
+		// The oldest, but it's still going.
+		{"20240103-000000-3", time.Time{}, day(1)},
+		// Never finished, so no manifest, and it's older than 1.
+		{"20240104-000000-12", time.Time{}, day(3)},
+		// Not one of ours.
+		{"backup", time.Time{}, day(1)},
+	}
+	for _, d := range dirs {
+		dir := filepath.Join(e.c.SpoolDir, d.name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if !d.manifest.IsZero() {
+			blob, err := json.Marshal(spoolManifest{Started: d.manifest})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, SpoolManifest), blob, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Chtimes(dir, d.modTime, d.modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pruneSpool(e, 1)
+	entries, err := ioutil.ReadDir(e.c.SpoolDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i := range entries {
+		got = append(got, entries[i].Name())
+	}
+	sort.Strings(got)
+	want := []string{"20240101-000000-1", "20240103-000000-3", "backup"}
+	if len(got) != len(want) {
+		t.Fatalf("left %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("left %v, want %v", got, want)
+		}
+	}
+}
@@ -9,122 +9,104 @@
 package main
 
 import (
-	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
 	"io"
 	"io/ioutil"
-	"net"
 	"os"
-	"os/exec"
 	"syscall"
 
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 // Given a path to an SSH private key, getPrivateKeyFile will return an *os.File
-// object. If it's an encrypted key it will prompt you for the passphrase,
-// make a temporary copy of the key in the TmpDir directory, and then
-// run ssh-keygen on it to strip the encryption. It will then open temporary
-// file, delete it, and hand you back an open *os.File to it.
+// object to read the key from. If it's an encrypted key it will prompt you
+// for the passphrase and decrypt it right here, so what you read is the key in
+// the clear.
 //
-// The error handling here is hella ugly. I am truely sorry for your lots.
+// What you get back is the read end of a pipe, with the key already written
+// into it. That way the key survives being daemonized (the pipe gets passed
+// down to the child like any other file) without it ever touching the disk.
 func getPrivateKeyFile(keyname string, e Env) (*os.File, error) {
-	var buf, pw []byte
-	var err error
-	var fp *os.File
-	var closeTheFile = true
-
-	fp, err = os.Open(keyname)
+	buf, err := ioutil.ReadFile(keyname)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if closeTheFile {
-			myErr := fp.Close()
-			if myErr != nil {
-				e.o.Debug("fp.Close(): %s\n", myErr)
-			}
+	if keyEncrypted(buf) {
+		if buf, err = decryptPrivateKey(keyname, buf, e); err != nil {
+			return nil, err
 		}
-	}()
-	// We read the file so we can tell if it's encrypted or not.
-	buf, err = ioutil.ReadAll(fp)
+	}
+	r, w, err := os.Pipe()
 	if err != nil {
 		return nil, err
 	}
-	_, err = fp.Seek(0, 0) // rewind
+	// Keys are a few KB at most, which fits in a pipe buffer, so this
+	// won't block waiting for a reader.
+	_, err = w.Write(buf)
+	if cErr := w.Close(); cErr != nil && err == nil {
+		err = cErr
+	}
 	if err != nil {
+		if cErr := r.Close(); cErr != nil {
+			e.o.Debug("r.Close(): %s\n", cErr)
+		}
 		return nil, err
 	}
-	if bytes.Contains(buf, []byte("ENCRYPTED")) {
-		// Need to reopen fp, so let's close it.
-		err = fp.Close()
-		closeTheFile = false
-		if err != nil {
-			e.o.Debug("fp.Close(): %s\n", err)
-			return nil, err
-		}
-		fp, err = ioutil.TempFile(os.Getenv("HOME")+TmpDir, "key")
-		if err != nil {
-			return nil, err
-		}
-		closeTheFile = true
-		tmpName := fp.Name()
-		defer func() {
-			// Yes at the end of this function, the caller will have
-			// an *os.File object that points to an unlinked file.
-			err = os.Remove(tmpName)
-			if err != nil {
-				e.o.Debug("os.Remove(): %s\n", err)
-			}
-		}()
-		_, err := fp.Write(buf)
-		if err != nil {
-			return nil, err
-		}
-		err = fp.Close()
-		if err != nil {
-			closeTheFile = false
-			e.o.Debug("fp.Close(): %s\n", err)
-			return nil, err
-		}
-		closeTheFile = false
-		// We now have copied the private key to tmpname.
+	return r, nil
+}
+
+// The keyEncrypted function tells us if a key needs a passphrase.
+func keyEncrypted(buf []byte) bool {
+	if block, _ := pem.Decode(buf); block != nil && block.Type == PEMEncryptedPKCS8 {
+		return true
+	}
+	_, err := ssh.ParseRawPrivateKey(buf)
+	_, ok := err.(*ssh.PassphraseMissingError)
+	return ok
+}
+
+// The decryptPrivateKey function asks for the passphrase of an encrypted
+// PEM, PKCS#8 or OpenSSH format key, giving you a few tries like ssh does,
+// and returns the key in the clear in OpenSSH format.
+func decryptPrivateKey(keyname string, buf []byte, e Env) ([]byte, error) {
+	var raw interface{}
+	var err error
+	for try := 0; try < PassphraseTries; try++ {
+		var pw []byte
 		e.o.Out("Passphrase for %s: ", keyname)
 		pw, err = terminal.ReadPassword(syscall.Stdin)
 		e.o.Out("\n")
 		if err != nil {
 			return nil, err
 		}
-		// Strip the passphrase from the temporary file.
-		// If somebody catches your passphrase in a ps listing before
-		// ssh-keygen sanitizes its **argv, I heartily apologize.
-		cmd := exec.Command(
-			SSHKeygen,
-			"-f",
-			tmpName,
-			"-N",
-			"",
-			"-P",
-			string(pw),
-			"-p",
-		)
-		if err = cmd.Start(); err != nil {
-			e.o.Debug("cmd.Start(): %s\n", err)
-			return nil, err
+		if block, _ := pem.Decode(buf); block != nil && block.Type == PEMEncryptedPKCS8 {
+			raw, err = decryptPKCS8(block.Bytes, pw)
+		} else {
+			raw, err = ssh.ParseRawPrivateKeyWithPassphrase(buf, pw)
 		}
-		if err = cmd.Wait(); err != nil {
-			return nil, err
+		for i := range pw {
+			pw[i] = 0
 		}
-		// Reopen, no encryption now.
-		fp, err = os.Open(tmpName)
-		closeTheFile = true
-		if err != nil {
-			return nil, err
+		if err != x509.IncorrectPasswordError {
+			break
 		}
+		e.o.Out("Bad passphrase, try again.\n")
+	}
+	if err != nil {
+		return nil, err
 	}
-	closeTheFile = false
-	return fp, nil
+	// OpenSSH format keys give us a pointer, PKCS#8 a value.
+	if k, ok := raw.(*ed25519.PrivateKey); ok {
+		raw = *k
+	}
+	block, err := ssh.MarshalPrivateKey(raw, "")
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
 }
 
 func makeSigner(fp io.ReadCloser, e Env) (ssh.Signer, error) {
@@ -145,43 +127,37 @@ func makeSigner(fp io.ReadCloser, e Env) (ssh.Signer, error) {
 	return signer, nil
 }
 
-// Using a forwarded agent connection can be very slow, especially if that
-// agent is running on a different continent from the hosts you are working
-// with. Your concurrency is limited to 128, because that's SOMAXCONN pretty
-// much  everywhere, but more importantly it's hard coded in ssh-agent as the
-// socket backlog. Connecting to any non-trivial amount of machines this
-// way can take a long time. Running a local agent really speeds things up.
-func getSSHConfigAgent(e Env) (*ssh.ClientConfig, error) {
-	agentsock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+// Given open files for each of the --key private keys, getSSHConfigFile will
+// return a pointer to an ssh.ClientConfig struct that tries all of them, and
+// their certificates, in the --identityorder.
+func getSSHConfigFile(fps []*os.File, e Env) (*ssh.ClientConfig, identitySource, error) {
+	ids, err := newIdentitySet(e.c.Key.values, fps, e.c.IdentityOrder, e)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	cfg := &ssh.ClientConfig{
 		User: e.c.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeysCallback(agent.NewClient(agentsock).Signers),
-		},
-	}
-	return cfg, nil
-}
-
-// Given the name of an encrypted or unencrypted PEM file with a private
-// SSH key, getSSHConfig will return a pointer to an ssh.ClientConfig struct.
-func getSSHConfigFile(fp *os.File, e Env) (*ssh.ClientConfig, error) {
-	signer, err := makeSigner(fp, e)
-	if err != nil || signer == nil {
-		return nil, err
+		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(ids.Signers)},
 	}
-	cfg := &ssh.ClientConfig{
-		User: e.c.User,
-		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
-	}
-	return cfg, nil
+	return cfg, ids, nil
 }
 
 func getSSHServerConfig(fp io.ReadCloser, e Env) (*ssh.ServerConfig, error) {
+	// We let anybody in (FIXME), but we ask for a key first so the audit log
+	// can say whose it was. Clients without one still get in with a
+	// keyboard-interactive exchange that asks nothing.
 	cfg := &ssh.ServerConfig{
-		NoClientAuth: true, // FIXME
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			perms := &ssh.Permissions{
+				Extensions: map[string]string{
+					FingerprintExt: ssh.FingerprintSHA256(key),
+				},
+			}
+			return perms, nil
+		},
+		KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return nil, nil
+		},
 	}
 	signer, err := makeSigner(fp, e)
 	if err != nil {
@@ -10,6 +10,9 @@ package main
 
 import (
 	"errors"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -30,6 +33,19 @@ type HostInfo struct {
 	runOK       bool
 	runOnce     bool
 	lastError   error
+	exitCode    int
+	attempts    []connectAttempt
+	authFailed  []string // The identities we offered, if auth failed
+	user        string   // Who to log in as, if not --user
+	tags        []string
+	meta        map[string]string
+}
+
+// A connectAttempt records the outcome of one try at connecting to a host.
+type connectAttempt struct {
+	startTime time.Time
+	duration  time.Duration
+	err       error
 }
 
 // ConnInfo is a struct that contains information about a connection that
@@ -40,6 +56,7 @@ type ConnInfo struct {
 	isProxy    bool
 	isDirect   bool
 	proxyCount int
+	via        string // Which alternative of an 'a|b' hop we connected to
 	reqChan    chan<- interface{}
 }
 
@@ -55,6 +72,58 @@ type WaiterInfo struct {
 	runStates   map[string]int
 }
 
+// RunRecord is an entry in the run history. It has the command we ran, when,
+// and how it went on each host.
+type RunRecord struct {
+	id       int
+	cmd      string
+	started  time.Time
+	finished time.Time
+	results  map[string]runResult
+}
+
+type runResult struct {
+	ok        bool
+	exitCode  int
+	runTime   time.Duration
+	err       error
+	outputSum string
+}
+
+func (rr *RunRecord) copy() RunRecord {
+	c := *rr
+	c.results = make(map[string]runResult, len(rr.results))
+	for k, v := range rr.results {
+		c.results[k] = v
+	}
+	return c
+}
+
+// FlapInfo keeps track of how many times a host or bastion has dropped its
+// connection and been reconnected, along with a short history of the flaps.
+type FlapInfo struct {
+	hostName     string
+	isProxy      bool
+	reconnects   int
+	failures     int
+	reconnecting bool
+	history      []flapEvent
+}
+
+type flapEvent struct {
+	when  time.Time
+	event string
+	err   error
+}
+
+const (
+	flapLost      = "lost"
+	flapFailed    = "reconnect failed"
+	flapRestored  = "restored"
+	flapFailover  = "failed over"
+	flapAbandoned = "abandoned"
+)
+
 type getPTR struct {
 	hostName string
 	respChan chan<- string
@@ -71,16 +140,69 @@ func (s *State) GetPTR(ip string) string {
 	return resp
 }
 
+type getPTRs struct {
+	respChan chan<- map[string]string
+}
+
+// GetPTRs returns a copy of the whole PTR map.
+func (s *State) GetPTRs() map[string]string {
+	respChan := make(chan map[string]string)
+	s.reqChan <- getPTRs{respChan}
+	resp := <-respChan
+	return resp
+}
+
+type setPTR struct {
+	ip       string
+	hostName string
+}
+
+// SetPTR adds an entry to the PTR map.
+func (s *State) SetPTR(ip, hostName string) {
+	s.reqChan <- setPTR{ip, hostName}
+}
+
+type forgetHost struct {
+	hostName string
+}
+
+// ForgetHost drops what we remember about a host that's gone for good: the
+// PTR entries that point at it, its flap history, and which of its
+// alternatives are down.
+func (s *State) ForgetHost(hostName string) {
+	s.reqChan <- forgetHost{hostName}
+}
+
+type getMetrics struct {
+	respChan chan<- Metrics
+}
+
+// GetMetrics returns a copy of the metrics that the serializer keeps, with
+// the gauges filled in.
+func (s *State) GetMetrics() Metrics {
+	respChan := make(chan Metrics)
+	s.reqChan <- getMetrics{respChan}
+	resp := <-respChan
+	return resp
+}
+
 type setConnectionStatus struct {
 	hostName    string
 	connectedOK bool
 	connectTime time.Duration
 	lastError   error
+	attempts    []connectAttempt
+	authFailed  []string
+	lost        bool // It was connected, and then it wasn't
 }
 
 // SetConnectionStatus sets the connection status for a host. Did it connect
-// OK, how long did it take? What was the error if not?
+// OK, how long did it take? What was the error if not? If it was an auth
+// failure, we note which identities didn't work.
 func (s *State) SetConnectionStatus(scs setConnectionStatus) {
+	if errorClass(scs.lastError) == kindAuth {
+		scs.authFailed = offeredIdentities(scs.lastError)
+	}
 	s.reqChan <- scs
 }
 
@@ -105,6 +227,9 @@ type setRunStatus struct {
 	runTime   time.Duration
 	lastError error
 	cmdOutput string
+	runID     int // The run this belongs to in the run history, if any
+	exitCode  int
+	outputSum string // Digest of the output, to tell if it changed
 }
 
 // SetRunStatus is like SetConnectionStatus but for command execution rather
@@ -113,6 +238,18 @@ func (s *State) SetRunStatus(srs setRunStatus) {
 	s.reqChan <- srs
 }
 
+type setHostTags struct {
+	hostName string
+	tags     []string
+	meta     map[string]string
+}
+
+// SetHostTags replaces the tags and meta of a target, leaving the rest of
+// what we know about it alone.
+func (s *State) SetHostTags(hostName string, tags []string, meta map[string]string) {
+	s.reqChan <- setHostTags{hostName, tags, meta}
+}
+
 type incProxyCount struct {
 	hostName string
 }
@@ -181,6 +318,191 @@ func (s *State) SetSSHConfig(sshConfig *ssh.ClientConfig) {
 	s.reqChan <- setSSHConfig{sshConfig}
 }
 
+type getIdentities struct {
+	respChan chan<- identitySource
+}
+
+// GetIdentities returns where our client identities come from.
+func (s *State) GetIdentities() identitySource {
+	respChan := make(chan identitySource)
+	s.reqChan <- getIdentities{respChan}
+	return <-respChan
+}
+
+type setIdentities struct {
+	ids identitySource
+}
+
+// SetIdentities sets where our client identities come from, --key or the
+// agent.
+func (s *State) SetIdentities(ids identitySource) {
+	s.reqChan <- setIdentities{ids}
+}
+
+type getMainOutput struct {
+	respChan chan<- *Output
+}
+
+// GetMainOutput returns our own Output, rather than that of whichever client
+// session we're doing something for. Things that outlive the session, like a
+// target plugin left running, should talk through it.
+func (s *State) GetMainOutput() *Output {
+	respChan := make(chan *Output)
+	s.reqChan <- getMainOutput{respChan}
+	return <-respChan
+}
+
+type setMainOutput struct {
+	o *Output
+}
+
+// SetMainOutput sets our own Output.
+func (s *State) SetMainOutput(o *Output) {
+	s.reqChan <- setMainOutput{o}
+}
+
+type getTargetPlugin struct {
+	respChan chan<- *targetPlugin
+}
+
+// GetTargetPlugin returns the target plugin that's still running, if there
+// is one.
+func (s *State) GetTargetPlugin() *targetPlugin {
+	respChan := make(chan *targetPlugin)
+	s.reqChan <- getTargetPlugin{respChan}
+	return <-respChan
+}
+
+type setTargetPlugin struct {
+	tp       *targetPlugin
+	respChan chan<- error
+}
+
+// SetTargetPlugin records tp as the running target plugin. Only one gets to
+// run at a time, so it's an error if there's one already.
+func (s *State) SetTargetPlugin(tp *targetPlugin) error {
+	respChan := make(chan error)
+	s.reqChan <- setTargetPlugin{tp, respChan}
+	return <-respChan
+}
+
+type clearTargetPlugin struct {
+	tp *targetPlugin
+}
+
+// ClearTargetPlugin forgets about tp once it's done running.
+func (s *State) ClearTargetPlugin(tp *targetPlugin) {
+	s.reqChan <- clearTargetPlugin{tp}
+}
+
+type getSelection struct {
+	respChan chan<- []string
+}
+
+// GetSelection returns the targets picked with select and exclude, or nil if
+// nothing has been picked and runs go everywhere.
+func (s *State) GetSelection() []string {
+	respChan := make(chan []string)
+	s.reqChan <- getSelection{respChan}
+	return <-respChan
+}
+
+type setSelection struct {
+	hosts []string
+}
+
+// SetSelection picks the targets that runs go to. Passing nil drops the
+// selection, so they go everywhere again.
+func (s *State) SetSelection(hosts []string) {
+	s.reqChan <- setSelection{hosts}
+}
+
+type getGroup struct {
+	name     string
+	respChan chan<- []string
+}
+
+// GetGroup returns the targets saved under a group name.
+func (s *State) GetGroup(name string) ([]string, error) {
+	respChan := make(chan []string)
+	s.reqChan <- getGroup{name, respChan}
+	hosts := <-respChan
+	if hosts == nil {
+		return nil, errors.New("No such group: " + name)
+	}
+	return hosts, nil
+}
+
+type setGroup struct {
+	name  string
+	hosts []string
+}
+
+// SetGroup saves a set of targets under a group name, replacing whatever
+// was there.
+func (s *State) SetGroup(name string, hosts []string) {
+	s.reqChan <- setGroup{name, hosts}
+}
+
+type deleteGroup struct {
+	name     string
+	respChan chan<- bool
+}
+
+// DeleteGroup forgets a group.
+func (s *State) DeleteGroup(name string) error {
+	respChan := make(chan bool)
+	s.reqChan <- deleteGroup{name, respChan}
+	if !<-respChan {
+		return errors.New("No such group: " + name)
+	}
+	return nil
+}
+
+type getGroupNames struct {
+	respChan chan<- []string
+}
+
+// GetGroupNames returns the names of all the groups, sorted.
+func (s *State) GetGroupNames() []string {
+	respChan := make(chan []string)
+	s.reqChan <- getGroupNames{respChan}
+	return <-respChan
+}
+
+type getMetaAgent struct {
+	respChan chan<- *MetaAgent
+}
+
+// GetMetaAgent returns the agent we serve to forwarded sessions.
+func (s *State) GetMetaAgent() *MetaAgent {
+	respChan := make(chan *MetaAgent)
+	s.reqChan <- getMetaAgent{respChan}
+	return <-respChan
+}
+
+type getOpenSSHConfig struct {
+	respChan chan<- *OpenSSHConfig
+}
+
+// GetOpenSSHConfig returns the user's parsed OpenSSH client config.
+func (s *State) GetOpenSSHConfig() *OpenSSHConfig {
+	respChan := make(chan *OpenSSHConfig)
+	s.reqChan <- getOpenSSHConfig{respChan}
+	resp := <-respChan
+	return resp
+}
+
+type setOpenSSHConfig struct {
+	openSSHConfig *OpenSSHConfig
+}
+
+// SetOpenSSHConfig sets the OpenSSH client config that we consult for per
+// host settings when connecting.
+func (s *State) SetOpenSSHConfig(openSSHConfig *OpenSSHConfig) {
+	s.reqChan <- setOpenSSHConfig{openSSHConfig}
+}
+
 type hostExists struct {
 	hostName string
 	respChan chan<- bool
@@ -188,7 +510,7 @@ type hostExists struct {
 
 type getHostInfo struct {
 	hostName string
-	respChan chan<- HostInfo
+	respChan chan<- *HostInfo
 }
 
 type deleteHostInfo struct {
@@ -204,18 +526,19 @@ type clearHostInfo struct {
 // that we may or may not have successfully connected to and run a command on.
 // Currently this info comes from the JSON dump we read at startup.
 func (s *State) GetHostInfo(hostName string) (HostInfo, error) {
-	if !s.HostExists(hostName) {
-		err := errors.New("Host '" + hostName + "' does not exit.")
-		return HostInfo{}, err
-	}
-	respChan := make(chan HostInfo)
+	respChan := make(chan *HostInfo)
 	ghi := getHostInfo{
 		hostName: hostName,
 		respChan: respChan,
 	}
 	s.reqChan <- ghi
 	resp := <-respChan
-	return resp, nil
+	// It can be removed at any time, like by a target plugin.
+	if resp == nil {
+		err := errors.New("Host '" + hostName + "' does not exist.")
+		return HostInfo{}, err
+	}
+	return *resp, nil
 }
 
 // ClearHostInfo initializes the HostInfo map. This is useful if you want to
@@ -274,25 +597,38 @@ type connExists struct {
 
 type getConnInfo struct {
 	hostName string
-	respChan chan<- ConnInfo
+	take     bool
+	respChan chan<- *ConnInfo
 }
 
 // GetConnInfo returns information about a host we've successfully connected to
 // The most important information here is the channel that we can use to send
 // commands to. This allows us to run a command on a host, or use it as a proxy.
 func (s *State) GetConnInfo(hostName string) (ConnInfo, error) {
-	if !s.ConnExists(hostName) {
-		err := errors.New("Connection '" + hostName + "' does not exist.")
-		return ConnInfo{}, err
-	}
-	respChan := make(chan ConnInfo)
+	return s.connInfo(hostName, false)
+}
+
+// TakeConnInfo deletes a connection from the map and returns it, all in one
+// go. Whoever takes it is the one who gets to clean it up, so it only gets
+// cleaned up once, no matter how many goroutines decide it's time.
+func (s *State) TakeConnInfo(hostName string) (ConnInfo, error) {
+	return s.connInfo(hostName, true)
+}
+
+func (s *State) connInfo(hostName string, take bool) (ConnInfo, error) {
+	respChan := make(chan *ConnInfo)
 	gci := getConnInfo{
 		hostName: hostName,
+		take:     take,
 		respChan: respChan,
 	}
 	s.reqChan <- gci
 	resp := <-respChan
-	return resp, nil
+	if resp == nil {
+		err := errors.New("Connection '" + hostName + "' does not exist.")
+		return ConnInfo{}, err
+	}
+	return *resp, nil
 }
 
 type setConnInfo struct {
@@ -320,20 +656,6 @@ func (s *State) ConnExists(hostName string) bool {
 	return resp
 }
 
-type deleteConnInfo struct {
-	hostName string
-	respChan chan<- bool
-}
-
-// DeleteConnInfo deletes a connection from the map, you'd want to do this
-// if the connection is no longer connected.
-func (s *State) DeleteConnInfo(hostName string) {
-	respChan := make(chan bool)
-	dci := deleteConnInfo{hostName, respChan}
-	s.reqChan <- dci
-	<-respChan
-}
-
 type getConnKeys struct {
 	respChan chan<- []string
 }
@@ -440,6 +762,147 @@ func (s *State) TimeoutWaiters() {
 	<-respChan
 }
 
+type recordFlap struct {
+	hostName string
+	isProxy  bool
+	event    string
+	err      error
+}
+
+// RecordFlap adds an event to the flap history of a host, and bumps its
+// reconnect or failure counters as appropriate.
+func (s *State) RecordFlap(hostName string, isProxy bool, event string, err error) {
+	s.reqChan <- recordFlap{s.GetPTR(hostName), isProxy, event, err}
+}
+
+type startReconnect struct {
+	hostName string
+	respChan chan<- bool
+}
+
+// StartReconnect marks a host as being reconnected. It returns false if
+// somebody else is already busy reconnecting it.
+func (s *State) StartReconnect(hostName string) bool {
+	respChan := make(chan bool)
+	s.reqChan <- startReconnect{s.GetPTR(hostName), respChan}
+	resp := <-respChan
+	return resp
+}
+
+type stopReconnect struct {
+	hostName string
+}
+
+// StopReconnect is called when the reconnect supervisor for a host is done,
+// whether it was successful or not.
+func (s *State) StopReconnect(hostName string) {
+	s.reqChan <- stopReconnect{s.GetPTR(hostName)}
+}
+
+type getReconnectCancel struct {
+	respChan chan<- chan struct{}
+}
+
+// GetReconnectCancel returns a channel that gets closed when all pending
+// reconnects should give up.
+func (s *State) GetReconnectCancel() <-chan struct{} {
+	respChan := make(chan chan struct{})
+	s.reqChan <- getReconnectCancel{respChan}
+	resp := <-respChan
+	return resp
+}
+
+type cancelReconnects struct{}
+
+// CancelReconnects makes every reconnect supervisor give up. We do this when
+// we disconnect on purpose, otherwise we'd just end up connecting again.
+func (s *State) CancelReconnects() {
+	s.reqChan <- cancelReconnects{}
+}
+
+type startRun struct {
+	cmd      string
+	respChan chan<- int
+}
+
+// StartRun adds a new run of cmd to the run history, and returns its ID. We
+// only remember the last RunHistory runs.
+func (s *State) StartRun(cmd string) int {
+	respChan := make(chan int)
+	s.reqChan <- startRun{cmd, respChan}
+	resp := <-respChan
+	return resp
+}
+
+type finishRun struct {
+	id int
+}
+
+// FinishRun marks a run in the history as done.
+func (s *State) FinishRun(id int) {
+	s.reqChan <- finishRun{id}
+}
+
+type getRuns struct {
+	respChan chan<- []RunRecord
+}
+
+// GetRuns returns a copy of the run history, oldest first.
+func (s *State) GetRuns() []RunRecord {
+	respChan := make(chan []RunRecord)
+	s.reqChan <- getRuns{respChan}
+	resp := <-respChan
+	return resp
+}
+
+// GetRun returns a copy of a single run from the history.
+func (s *State) GetRun(id int) (RunRecord, error) {
+	runs := s.GetRuns()
+	for i := range runs {
+		if runs[i].id == id {
+			return runs[i], nil
+		}
+	}
+	return RunRecord{}, errors.New("Run " + strconv.Itoa(id) + " is not in the history.")
+}
+
+type getFlapInfo struct {
+	respChan chan<- []FlapInfo
+}
+
+// GetFlapInfo returns a copy of the flap history of every host that has
+// ever dropped its connection.
+func (s *State) GetFlapInfo() []FlapInfo {
+	respChan := make(chan []FlapInfo)
+	s.reqChan <- getFlapInfo{respChan}
+	resp := <-respChan
+	return resp
+}
+
+type setAltDown struct {
+	alt  string
+	down bool
+}
+
+// SetAltDown marks one alternative of an 'a|b' chain hop as down, or as
+// working again. Alternatives that are down get tried last.
+func (s *State) SetAltDown(alt string, down bool) {
+	s.reqChan <- setAltDown{alt, down}
+}
+
+type isAltDown struct {
+	alt      string
+	respChan chan<- bool
+}
+
+// IsAltDown returns true if the given alternative was marked as down.
+func (s *State) IsAltDown(alt string) bool {
+	respChan := make(chan bool)
+	s.reqChan <- isAltDown{alt, respChan}
+	resp := <-respChan
+	return resp
+}
+
 // State is a singleton object that holds all global program information.
 // These would be obnoxious global variables if we didn't need to serialize
 // access to them to ensure that reading and writing them is thread-safe.
@@ -449,8 +912,21 @@ type State struct {
 	PTR         map[string]string
 	connWaiters map[string]*waitInfo
 	runWaiters  map[string]*waitInfo
+	flaps       map[string]*FlapInfo
+	altDown     map[string]bool
+	metrics     *Metrics
+	runs        []*RunRecord
+	lastRunID   int
+	reconCancel chan struct{}
 	reqChan     chan interface{}
 	sshConfig   *ssh.ClientConfig
+	openSSH     *OpenSSHConfig
+	identities  identitySource
+	mainOutput  *Output
+	agent       *MetaAgent
+	selected    map[string]bool // nil when nothing's been selected
+	groups      map[string][]string
+	plugin      *targetPlugin
 	sshAuthPass string
 }
 
@@ -464,6 +940,12 @@ func NewState() *State {
 	s.PTR = make(map[string]string)
 	s.connWaiters = make(map[string]*waitInfo)
 	s.runWaiters = make(map[string]*waitInfo)
+	s.flaps = make(map[string]*FlapInfo)
+	s.altDown = make(map[string]bool)
+	s.metrics = newMetrics()
+	s.agent = NewMetaAgent()
+	s.groups = make(map[string][]string)
+	s.reconCancel = make(chan struct{})
 	s.reqChan = make(chan interface{})
 
 	go s.serializer()
@@ -518,6 +1000,96 @@ func (s *State) serializer() {
 				connStates,
 				runStates,
 			}
+		case recordFlap:
+			rfReq := req.(recordFlap)
+			fi, exists := s.flaps[rfReq.hostName]
+			if !exists {
+				fi = &FlapInfo{hostName: rfReq.hostName}
+				s.flaps[rfReq.hostName] = fi
+			}
+			fi.isProxy = rfReq.isProxy
+			switch rfReq.event {
+			case flapRestored, flapFailover:
+				fi.reconnects++
+			case flapFailed:
+				fi.failures++
+			case flapLost:
+				s.metrics.observeLost(rfReq.err)
+			}
+			fi.history = append(fi.history, flapEvent{time.Now(), rfReq.event, rfReq.err})
+			if len(fi.history) > FlapHistory {
+				fi.history = fi.history[len(fi.history)-FlapHistory:]
+			}
+		case setAltDown:
+			sadReq := req.(setAltDown)
+			if sadReq.down {
+				s.altDown[sadReq.alt] = true
+			} else {
+				delete(s.altDown, sadReq.alt)
+			}
+		case isAltDown:
+			iadReq := req.(isAltDown)
+			iadReq.respChan <- s.altDown[iadReq.alt]
+		case startReconnect:
+			srReq := req.(startReconnect)
+			fi, exists := s.flaps[srReq.hostName]
+			if !exists {
+				fi = &FlapInfo{hostName: srReq.hostName}
+				s.flaps[srReq.hostName] = fi
+			}
+			if fi.reconnecting {
+				srReq.respChan <- false
+			} else {
+				fi.reconnecting = true
+				srReq.respChan <- true
+			}
+		case stopReconnect:
+			srReq := req.(stopReconnect)
+			if fi, exists := s.flaps[srReq.hostName]; exists {
+				fi.reconnecting = false
+			}
+		case getReconnectCancel:
+			grcReq := req.(getReconnectCancel)
+			grcReq.respChan <- s.reconCancel
+		case cancelReconnects:
+			close(s.reconCancel)
+			s.reconCancel = make(chan struct{})
+		case startRun:
+			srReq := req.(startRun)
+			s.lastRunID++
+			s.runs = append(s.runs, &RunRecord{
+				id:      s.lastRunID,
+				cmd:     srReq.cmd,
+				started: time.Now(),
+				results: make(map[string]runResult),
+			})
+			if len(s.runs) > RunHistory {
+				s.runs = s.runs[len(s.runs)-RunHistory:]
+			}
+			srReq.respChan <- s.lastRunID
+		case finishRun:
+			frReq := req.(finishRun)
+			for i := range s.runs {
+				if s.runs[i].id == frReq.id {
+					s.runs[i].finished = time.Now()
+				}
+			}
+		case getRuns:
+			grReq := req.(getRuns)
+			runs := make([]RunRecord, len(s.runs))
+			for i := range s.runs {
+				runs[i] = s.runs[i].copy()
+			}
+			grReq.respChan <- runs
+		case getFlapInfo:
+			var flaps []FlapInfo
+			gfiReq := req.(getFlapInfo)
+			for k := range s.flaps {
+				fi := *s.flaps[k]
+				fi.history = append([]flapEvent(nil), fi.history...)
+				flaps = append(flaps, fi)
+			}
+			gfiReq.respChan <- flaps
 		case deleteConnWaitInfo:
 			dcwiReq := req.(deleteConnWaitInfo)
 			delete(s.connWaiters, dcwiReq.hostName)
@@ -550,20 +1122,79 @@ func (s *State) serializer() {
 			} else {
 				gpReq.respChan <- gpReq.hostName
 			}
+		case forgetHost:
+			fhReq := req.(forgetHost)
+			for ip, hostName := range s.PTR {
+				if hostName == fhReq.hostName {
+					delete(s.PTR, ip)
+				}
+			}
+			delete(s.flaps, fhReq.hostName)
+			for _, alt := range strings.Split(fhReq.hostName, "|") {
+				delete(s.altDown, alt)
+			}
+		case getPTRs:
+			gpsReq := req.(getPTRs)
+			ptrs := make(map[string]string, len(s.PTR))
+			for k, v := range s.PTR {
+				ptrs[k] = v
+			}
+			gpsReq.respChan <- ptrs
+		case getMetrics:
+			gmReq := req.(getMetrics)
+			m := s.metrics.copy()
+			m.targets = len(s.targets)
+			for k := range s.conn {
+				if s.conn[k].isProxy {
+					m.proxies++
+				} else if _, exists := s.targets[k]; exists {
+					m.connectedHost++
+				}
+			}
+			gmReq.respChan <- m
+		case setPTR:
+			spReq := req.(setPTR)
+			s.PTR[spReq.ip] = spReq.hostName
 		case setConnectionStatus:
 			scsReq := req.(setConnectionStatus)
 			if _, exists := s.targets[scsReq.hostName]; exists {
+				if !scsReq.lost {
+					s.metrics.observeConnect(scsReq.connectedOK, scsReq.connectTime, scsReq.lastError)
+				}
 				s.targets[scsReq.hostName].connectedOK = scsReq.connectedOK
 				s.targets[scsReq.hostName].connectTime = scsReq.connectTime
 				s.targets[scsReq.hostName].lastError = scsReq.lastError
+				if scsReq.attempts != nil {
+					s.targets[scsReq.hostName].attempts = scsReq.attempts
+				}
+				s.targets[scsReq.hostName].authFailed = scsReq.authFailed
+			}
+		case setHostTags:
+			shtReq := req.(setHostTags)
+			if hi, exists := s.targets[shtReq.hostName]; exists {
+				hi.tags = shtReq.tags
+				hi.meta = shtReq.meta
 			}
 		case setRunStatus:
 			srsReq := req.(setRunStatus)
 			if _, exists := s.targets[srsReq.hostName]; exists {
+				s.metrics.observeRun(srsReq.runOK, srsReq.runTime, srsReq.lastError)
 				s.targets[srsReq.hostName].runOK = srsReq.runOK
 				s.targets[srsReq.hostName].runOnce = srsReq.runOnce
 				s.targets[srsReq.hostName].runTime = srsReq.runTime
 				s.targets[srsReq.hostName].lastError = srsReq.lastError
+				s.targets[srsReq.hostName].exitCode = srsReq.exitCode
+			}
+			for i := range s.runs {
+				if s.runs[i].id == srsReq.runID {
+					s.runs[i].results[srsReq.hostName] = runResult{
+						ok:        srsReq.runOK,
+						exitCode:  srsReq.exitCode,
+						runTime:   srsReq.runTime,
+						err:       srsReq.lastError,
+						outputSum: srsReq.outputSum,
+					}
+				}
 			}
 		case incProxyCount:
 			ipcReq := req.(incProxyCount)
@@ -580,6 +1211,90 @@ func (s *State) serializer() {
 		case setSSHConfig:
 			sscReq := req.(setSSHConfig)
 			s.sshConfig = sscReq.sshConfig
+		case getIdentities:
+			giReq := req.(getIdentities)
+			giReq.respChan <- s.identities
+		case setIdentities:
+			siReq := req.(setIdentities)
+			s.identities = siReq.ids
+		case getMainOutput:
+			gmoReq := req.(getMainOutput)
+			gmoReq.respChan <- s.mainOutput
+		case setMainOutput:
+			smoReq := req.(setMainOutput)
+			s.mainOutput = smoReq.o
+		case getTargetPlugin:
+			gtpReq := req.(getTargetPlugin)
+			gtpReq.respChan <- s.plugin
+		case setTargetPlugin:
+			stpReq := req.(setTargetPlugin)
+			if s.plugin != nil {
+				stpReq.respChan <- errors.New("A target plugin is already running.")
+				continue
+			}
+			s.plugin = stpReq.tp
+			stpReq.respChan <- nil
+		case clearTargetPlugin:
+			ctpReq := req.(clearTargetPlugin)
+			if s.plugin == ctpReq.tp {
+				s.plugin = nil
+			}
+		case getSelection:
+			gsReq := req.(getSelection)
+			if s.selected == nil {
+				gsReq.respChan <- nil
+				continue
+			}
+			keys := []string{}
+			for k := range s.selected {
+				if _, exists := s.targets[k]; exists {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			gsReq.respChan <- keys
+		case setSelection:
+			ssReq := req.(setSelection)
+			if ssReq.hosts == nil {
+				s.selected = nil
+				continue
+			}
+			s.selected = make(map[string]bool, len(ssReq.hosts))
+			for i := range ssReq.hosts {
+				s.selected[ssReq.hosts[i]] = true
+			}
+		case getGroup:
+			ggReq := req.(getGroup)
+			hosts, exists := s.groups[ggReq.name]
+			if exists {
+				hosts = append([]string{}, hosts...)
+			}
+			ggReq.respChan <- hosts
+		case setGroup:
+			sgReq := req.(setGroup)
+			s.groups[sgReq.name] = append([]string{}, sgReq.hosts...)
+		case deleteGroup:
+			dgReq := req.(deleteGroup)
+			_, exists := s.groups[dgReq.name]
+			delete(s.groups, dgReq.name)
+			dgReq.respChan <- exists
+		case getGroupNames:
+			ggnReq := req.(getGroupNames)
+			var names []string
+			for k := range s.groups {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			ggnReq.respChan <- names
+		case getMetaAgent:
+			gmaReq := req.(getMetaAgent)
+			gmaReq.respChan <- s.agent
+		case getOpenSSHConfig:
+			goscReq := req.(getOpenSSHConfig)
+			goscReq.respChan <- s.openSSH
+		case setOpenSSHConfig:
+			soscReq := req.(setOpenSSHConfig)
+			s.openSSH = soscReq.openSSHConfig
 		case HostInfo:
 			hiReq := req.(HostInfo)
 			s.targets[hiReq.hostName] = &hiReq
@@ -591,7 +1306,13 @@ func (s *State) serializer() {
 			}
 		case getHostInfo:
 			ghiReq := req.(getHostInfo)
-			ghiReq.respChan <- *s.targets[ghiReq.hostName]
+			hi, exists := s.targets[ghiReq.hostName]
+			if !exists {
+				ghiReq.respChan <- nil
+				continue
+			}
+			found := *hi
+			ghiReq.respChan <- &found
 		case deleteHostInfo:
 			dhiReq := req.(deleteHostInfo)
 			delete(s.targets, dhiReq.hostName)
@@ -600,6 +1321,7 @@ func (s *State) serializer() {
 			chiReq := req.(clearHostInfo)
 			// this shit is garbage collected right?
 			s.targets = make(map[string]*HostInfo)
+			s.selected = nil
 			chiReq.respChan <- true
 		case hostExists:
 			heReq := req.(hostExists)
@@ -607,15 +1329,20 @@ func (s *State) serializer() {
 			heReq.respChan <- exists
 		case getConnInfo:
 			gciReq := req.(getConnInfo)
-			gciReq.respChan <- *s.conn[gciReq.hostName]
+			ci, exists := s.conn[gciReq.hostName]
+			if !exists {
+				gciReq.respChan <- nil
+				continue
+			}
+			if gciReq.take {
+				delete(s.conn, gciReq.hostName)
+			}
+			found := *ci
+			gciReq.respChan <- &found
 		case connExists:
 			ceReq := req.(connExists)
 			_, exists := s.conn[ceReq.hostName]
 			ceReq.respChan <- exists
-		case deleteConnInfo:
-			dciReq := req.(deleteConnInfo)
-			delete(s.conn, dciReq.hostName)
-			dciReq.respChan <- true
 		case getHostKeys:
 			var keys []string
 			ghkReq := req.(getHostKeys)
@@ -8,32 +8,10 @@
 
 package main
 
-import (
-	"strings"
+import "strings"
 
-	"github.com/bmizerany/perks/quantile"
-)
-
-func printSummary(e Env, verbose bool) {
-	errs := []string{
-		"connection refused",
-		"too many open files",
-		"connection reset by peer",
-		"no supported methods remain",
-		"administratively prohibited",
-		"no route to host",
-		"connection timed out",
-		"connection aborted",
-		"unexpected packet",
-		"run timed out",
-		"run aborted",
-		"eof",
-		"no common algorithm",
-		"process exited with status",
-	}
-
-	var requiresPwHosts []string
-	var hk = e.s.GetHostKeys()
+func printSummary(e Env, hk []string, verbose bool) {
+	var requiresPwHosts, retriedHosts []string
 	connectErrorCounts := make(map[string]int)
 	connectErrorHosts := make(map[string][]string)
 	runErrorCounts := make(map[string]int)
@@ -47,8 +25,7 @@ func printSummary(e Env, verbose bool) {
 	connectedOK := 0
 	requiresPw := 0
 
-	qConnect := quantile.NewBiased()
-	qRun := quantile.NewBiased()
+	var connectTimes, runTimes []float64
 
 	for i := range hk {
 		hostname := hk[i]
@@ -64,11 +41,11 @@ func printSummary(e Env, verbose bool) {
 			runOnce++
 		}
 		if hi.runOK && hi.runOnce {
-			qRun.Insert(hi.runTime.Seconds())
+			runTimes = append(runTimes, hi.runTime.Seconds())
 			runTimeToHost[hi.runTime.Seconds()] = hostname
 		}
 		if hi.connectedOK {
-			qConnect.Insert(hi.connectTime.Seconds())
+			connectTimes = append(connectTimes, hi.connectTime.Seconds())
 			conTimeToHost[hi.connectTime.Seconds()] = hostname
 			connectedOK++
 		}
@@ -76,65 +53,74 @@ func printSummary(e Env, verbose bool) {
 			requiresPw++
 			requiresPwHosts = append(requiresPwHosts, hostname)
 		}
+		if len(hi.attempts) > 1 {
+			retriedHosts = append(retriedHosts, hostname)
+		}
 		if hi.lastError != nil {
-			found := false
-			for e := range errs {
-				errstr := strings.ToLower(hi.lastError.Error())
-				if strings.Contains(errstr, errs[e]) {
-					found = true
-					if !hi.connectedOK {
-						connectErrorCounts[errs[e]]++
-						connectErrorHosts[errs[e]] = append(
-							connectErrorHosts[errs[e]],
-							hostname,
-						)
-					} else {
-						runErrorCounts[errs[e]]++
-						runErrorHosts[errs[e]] = append(
-							runErrorHosts[errs[e]],
-							hostname,
-						)
-					}
-					break
-				}
-			}
-			if !found {
+			class := errorLabel(hi.lastError)
+			if errorClass(hi.lastError) == UnknownError {
 				if !hi.connectedOK {
 					e.o.Debug("Connect UNK: %s\n", hi.lastError.Error())
-					connectErrorCounts[UnknownError]++
 				} else {
 					e.o.Debug("Run UNK: %s\n", hi.lastError.Error())
-					runErrorCounts[UnknownError]++
 				}
 			}
+			if !hi.connectedOK {
+				what := hostname
+				if len(hi.authFailed) > 0 {
+					what += " (tried " + strings.Join(hi.authFailed, ", ") + ")"
+				}
+				connectErrorCounts[class]++
+				connectErrorHosts[class] = append(
+					connectErrorHosts[class],
+					what,
+				)
+			} else {
+				runErrorCounts[class]++
+				runErrorHosts[class] = append(
+					runErrorHosts[class],
+					hostname,
+				)
+			}
 		}
 	}
 
 	runFail := runOnce - runOK
 	connectFail := numEntries - connectedOK
 
+	qConnect := newSamples(connectTimes)
+	qRun := newSamples(runTimes)
+
 	e.o.Out("Quantile:    1%%     25%%     50%%     90%%    99%%\n")
 	e.o.Out("         +-------+-------+-------+-------+------+\n")
 	e.o.Out("Connect:  %05.2fs, %05.2fs, %05.2fs, %05.2fs, %05.2fs (%d samples)\n",
-		qConnect.Query(0.1),
-		qConnect.Query(0.25),
-		qConnect.Query(0.50),
-		qConnect.Query(0.90),
-		qConnect.Query(0.99),
-		qConnect.Count(),
+		qConnect.percentile(0.01),
+		qConnect.percentile(0.25),
+		qConnect.percentile(0.50),
+		qConnect.percentile(0.90),
+		qConnect.percentile(0.99),
+		len(qConnect),
 	)
-	if qRun.Count() > 0 {
+	if len(qRun) > 0 {
 		e.o.Out("Run:      %05.2fs, %05.2fs, %05.2fs, %05.2fs, %05.2fs (%d samples)\n",
-			qRun.Query(0.1),
-			qRun.Query(0.25),
-			qRun.Query(0.50),
-			qRun.Query(0.90),
-			qRun.Query(0.99),
-			qRun.Count(),
+			qRun.percentile(0.01),
+			qRun.percentile(0.25),
+			qRun.percentile(0.50),
+			qRun.percentile(0.90),
+			qRun.percentile(0.99),
+			len(qRun),
 		)
 	}
 	e.o.Out("\n\t%d connection failures\n", connectFail)
 	outputErrors(e, connectErrorCounts, connectErrorHosts, verbose)
+	if len(retriedHosts) > 0 {
+		e.o.Out("\tneeded retries(%d)\n", len(retriedHosts))
+		if verbose {
+			for i := range retriedHosts {
+				outputAttempts(e, retriedHosts[i])
+			}
+		}
+	}
 	if e.c.Password {
 		e.o.Out("\trequired a password(%d)\n", requiresPw)
 		if verbose {
@@ -143,26 +129,32 @@ func printSummary(e Env, verbose bool) {
 			}
 		}
 	}
-	if qRun.Count() > 0 {
+	if len(qRun) > 0 {
 		e.o.Out("\t%d run failures\n", runFail)
 	}
 	outputErrors(e, runErrorCounts, runErrorHosts, verbose)
 	e.o.Out("\n")
+	outputFlaps(e, verbose)
 
-	qConSamp := qConnect.Samples()
-	qRunSamp := qRun.Samples()
-
-	if len(qConSamp) > 0 {
-		fastSlow(e, "Con", qConSamp, conTimeToHost)
+	if len(qConnect) > 0 {
+		fastSlow(e, "Con", qConnect, conTimeToHost)
+	}
+	if len(qRun) > 0 {
+		fastSlow(e, "Run", qRun, runTimeToHost)
 	}
-	if len(qRunSamp) > 0 {
-		fastSlow(e, "Run", qRunSamp, runTimeToHost)
+	if verbose {
+		if len(qConnect) > 0 {
+			outputHistogram(e, "Connect", qConnect)
+		}
+		if len(qRun) > 0 {
+			outputHistogram(e, "Run", qRun)
+		}
 	}
 }
 
-func fastSlow(e Env, what string, s quantile.Samples, tm map[float64]string) {
-	fast := s[0].Value
-	slow := s[len(s)-1].Value
+func fastSlow(e Env, what string, s samples, tm map[float64]string) {
+	fast := s[0]
+	slow := s[len(s)-1]
 
 	fastHost := tm[fast]
 	slowHost := tm[slow]
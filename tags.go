@@ -0,0 +1,151 @@
+/*
+ * tags.go
+ *
+ * The target JSON can carry more than a name and a chain. Each entry can have
+ * a "tags" list and a "meta" object, say:
+ *
+ *	{"name": "db-1", "tags": ["db", "primary"], "meta": {"dc": "sjc1", "rack": 12}}
+ *
+ * We keep both in HostInfo. The select command can match on them with
+ * tag=primary or dc=sjc1, summary --by dc breaks the results down by a meta
+ * key, and run -T fills in {{.Meta.dc}} style templates per host. That's
+ * opt-in, since plenty of commands have templates of their own for the far
+ * end, like docker ps --format '{{.Names}}'.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// The metaStrings function turns the meta object from the JSON into strings,
+// since the targets may well give us numbers or booleans for some keys.
+func metaStrings(raw map[string]interface{}) map[string]string {
+	if len(raw) == 0 {
+		return nil
+	}
+	meta := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if v == nil {
+			meta[k] = ""
+			continue
+		}
+		meta[k] = fmt.Sprint(v)
+	}
+	return meta
+}
+
+// The hostField function returns the value of field for a host. That's one
+// of the string fields select knows about, or else a meta key.
+func hostField(hi HostInfo, field string) string {
+	if f, exists := stringFields[field]; exists {
+		return f(hi)
+	}
+	return hi.meta[field]
+}
+
+// A cmdTemplate is a command to run, which may have bits that get filled in
+// from each host's name, address, tags and meta.
+type cmdTemplate struct {
+	cmd  string
+	tmpl *template.Template
+}
+
+// What a command template gets to see of a host.
+type hostTemplateData struct {
+	Name string
+	IP   string
+	Tags []string
+	Meta map[string]string
+}
+
+// The newCmdTemplate function parses cmd as a template if fill is set and
+// it looks like one. Otherwise it's run as it is.
+func newCmdTemplate(cmd string, fill bool) (*cmdTemplate, error) {
+	ct := &cmdTemplate{cmd: cmd}
+	if !fill || !strings.Contains(cmd, "{{") {
+		return ct, nil
+	}
+	tmpl, err := template.New("run").Option("missingkey=zero").Parse(cmd)
+	if err != nil {
+		return nil, err
+	}
+	ct.tmpl = tmpl
+	return ct, nil
+}
+
+// The forHost method returns the command to run on a host.
+func (ct *cmdTemplate) forHost(hi HostInfo) (string, error) {
+	if ct.tmpl == nil {
+		return ct.cmd, nil
+	}
+	name, _ := splitLink(hi.ipAddress)
+	var buf bytes.Buffer
+	err := ct.tmpl.Execute(&buf, hostTemplateData{
+		Name: hi.hostName,
+		IP:   name,
+		Tags: hi.tags,
+		Meta: hi.meta,
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// The printBreakdown function outputs how the hosts in hk did, grouped by
+// the value of field. Hosts without it are lumped together under "-".
+func printBreakdown(e Env, hk []string, field string) {
+	type counts struct {
+		targets, connected, connectFail, ran, runFail int
+	}
+	byValue := make(map[string]*counts)
+	for i := range hk {
+		hi, err := e.s.GetHostInfo(hk[i])
+		if err != nil {
+			e.o.Debug("GetHostInfo(): %s\n", err)
+			continue
+		}
+		value := hostField(hi, field)
+		if value == "" {
+			value = "-"
+		}
+		c, exists := byValue[value]
+		if !exists {
+			c = &counts{}
+			byValue[value] = c
+		}
+		c.targets++
+		if hi.connectedOK {
+			c.connected++
+		} else {
+			c.connectFail++
+		}
+		if hi.runOnce {
+			c.ran++
+			if !hi.runOK {
+				c.runFail++
+			}
+		}
+	}
+	values := make([]string, 0, len(byValue))
+	for v := range byValue {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	e.o.Out("By %s:\n", field)
+	e.o.Out("\t%-20s %8s %10s %13s %6s %12s\n",
+		field, "targets", "connected", "conn failures", "ran", "run failures")
+	for i := range values {
+		c := byValue[values[i]]
+		e.o.Out("\t%-20s %8d %10d %13d %6d %12d\n",
+			values[i], c.targets, c.connected, c.connectFail, c.ran, c.runFail)
+	}
+	e.o.Out("\n")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// The fakeRunHost function makes host a target with a connection that
+// answers run requests with stdOut, and hands each command it gets to cmds.
+func fakeRunHost(s *State, hi HostInfo, stdOut string, cmds chan<- string) {
+	reqChan := make(chan interface{})
+	go func() {
+		for req := range reqChan {
+			if rr, ok := req.(runRequest); ok {
+				cmds <- rr.cmd
+				rr.response <- runResponse{stdOut: stdOut}
+			}
+		}
+	}()
+	s.SetHostInfo(hi)
+	s.SetConnInfo(&ConnInfo{hostName: hi.hostName, reqChan: reqChan})
+}
+
+func testEnv() (Env, *bytes.Buffer) {
+	var out bytes.Buffer
+	c := &Config{Concurrency: 4, Timeout: 5}
+	return Env{s: NewState(), o: NewOutput(&out, &out, false, false), c: c}, &out
+}
+
+func TestCmdTemplate(t *testing.T) {
+	hi := HostInfo{
+		hostName:  "db-1",
+		ipAddress: "10.0.0.1:2222",
+		tags:      []string{"db"},
+		meta:      map[string]string{"dc": "sjc1"},
+	}
+	tests := []struct {
+		cmd  string
+		fill bool
+		want string
+	}{
+		{"uptime", false, "uptime"},
+		{"uptime", true, "uptime"},
+		{"docker ps --format '{{.Names}}'", false, "docker ps --format '{{.Names}}'"},
+		{"kubectl get pods -o go-template='{{range .items}}{{.metadata.name}}{{end}}'", false,
+			"kubectl get pods -o go-template='{{range .items}}{{.metadata.name}}{{end}}'"},
+		{"echo {{.Name}} {{.IP}} {{.Meta.dc}} {{.Meta.rack}}", true, "echo db-1 10.0.0.1 sjc1 "},
+		{"echo {{.Tags}}", true, "echo [db]"},
+	}
+	for _, tt := range tests {
+		ct, err := newCmdTemplate(tt.cmd, tt.fill)
+		if err != nil {
+			t.Errorf("%q: %s", tt.cmd, err)
+			continue
+		}
+		got, err := ct.forHost(hi)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q, %v, want %q", tt.cmd, got, err, tt.want)
+		}
+	}
+	if _, err := newCmdTemplate("echo {{.Name", true); err == nil {
+		t.Error("a broken template parsed")
+	}
+}
+
+func TestRunLeavesTemplatesAlone(t *testing.T) {
+	e, _ := testEnv()
+	cmds := make(chan string, 1)
+	fakeRunHost(e.s, HostInfo{hostName: "web-1", ipAddress: "web-1"}, "", cmds)
+	cmd := "docker ps --format '{{.Names}}'"
+	ct, err := newCmdTemplate(cmd, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runEverywhere(e.s.StartRun(cmd), ct, []string{"web-1"}, e, e.c.Timeout)
+	if got := <-cmds; got != cmd {
+		t.Errorf("the host got %q, want %q", got, cmd)
+	}
+}
@@ -0,0 +1,523 @@
+/*
+ * targetplugin.go
+ *
+ * The 'target' command runs TargetCmd and loads the hosts it prints. Old
+ * target programs print one big JSON array, and we can't do anything with it
+ * until they're done. Newer ones speak a line at a time, so we can get going
+ * on a big inventory before it's all there:
+ *
+ *	{"op": "hello", "version": 1}
+ *	{"op": "add", "name": "db-1", "chain": "bastion db-1", "tags": ["db"]}
+ *	{"op": "remove", "name": "web-7"}
+ *	{"op": "ready"}
+ *
+ * The hello comes first and says which version of this protocol the plugin
+ * speaks. An add has the same fields as an entry in the JSON array, and the
+ * host gets connected as soon as it's in. An add for a host we already have
+ * is ignored, so to change one, remove it and add it again. A remove
+ * disconnects a host and drops it from the targets. Once the plugin says
+ * ready, 'target' returns and leaves it running in the background, where it
+ * can keep adding and removing hosts as they come and go, until it exits or
+ * 'target --stop' stops it. A plugin that never says ready has 'target' wait
+ * for it to exit, like the old ones.
+ *
+ * With 'target --sync', the adds up to the ready, or up to the end if there
+ * isn't one, are taken to be the whole inventory, and the targets are
+ * reconciled against them. After that, it's adds and removes as usual, and
+ * a remove that leaves a bastion with nobody behind it disconnects that too.
+ *
+ * Anything the plugin writes to STDERR is shown as it comes, so it can say
+ * how it's getting on.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+)
+
+// TargetProtocolVersion is the newest version of the plugin protocol we
+// speak.
+const TargetProtocolVersion = 1
+
+// The ops in the plugin protocol.
+const (
+	targetOpHello  = "hello"
+	targetOpAdd    = "add"
+	targetOpRemove = "remove"
+	targetOpReady  = "ready"
+)
+
+// A targetRecord is one line of output from a target plugin.
+type targetRecord struct {
+	Op      string `json:"op"`
+	Version int    `json:"version"`
+	Server
+}
+
+// A targetPlugin is a target program that speaks the plugin protocol.
+type targetPlugin struct {
+	cmd     *exec.Cmd
+	e       Env // The session's until it's left running, then our own
+	mu      sync.Mutex
+	pending []string // Added hosts waiting to be connected
+	added   int
+	removed int
+	stopped bool // We killed it with target --stop
+	syncing bool // Collecting the inventory for target --sync
+	force   bool // Let target --sync remove every target
+	synced  []Server
+	report  *syncReport
+	kick    chan struct{}
+	ready   chan struct{}
+	done    chan error
+}
+
+// The runTarget function runs the target command with args and loads the
+// hosts it gives us, or reconciles the targets with them.
+func runTarget(e Env, args []string, reconcile, force bool) error {
+	var wg sync.WaitGroup
+	cmd := exec.Command(e.c.TargetCmd, args...)
+	// Its own process group, so stopping a plugin that's a shell script
+	// gets whatever it's running too.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		e.o.Debug("cmd.Start(): %s\n", err)
+		return err
+	}
+	tp := &targetPlugin{
+		cmd:     cmd,
+		e:       e,
+		kick:    make(chan struct{}, 1),
+		ready:   make(chan struct{}),
+		done:    make(chan error, 1),
+		syncing: reconcile,
+		force:   force,
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tp.relayStderr(stderr)
+	}()
+	r := bufio.NewReader(stdout)
+	if !isJSONArray(r) {
+		return tp.start(r, &wg)
+	}
+	// The old way, a JSON array of everything when the command is done.
+	blob, err := ioutil.ReadAll(r)
+	if err != nil {
+		e.o.Debug("ReadAll(): %s\n", err)
+	}
+	wg.Wait()
+	if err := targetExit(cmd.Wait(), e); err != nil {
+		return err
+	}
+	if len(blob) == 0 && !reconcile {
+		return nil
+	}
+	var servers []Server
+	if len(blob) > 0 {
+		if servers, err = parseServers(blob); err != nil {
+			return errors.New("Load JSON from STDOUT: " + err.Error())
+		}
+	}
+	if reconcile {
+		return syncTargets(e, servers, force)
+	}
+	n, err := NewJSON(e).LoadServers(servers)
+	if err != nil {
+		return err
+	}
+	e.o.Out("Targeted %d hosts.\n", n)
+	return nil
+}
+
+// The isJSONArray function peeks past any white space to see if the output
+// is a JSON array, rather than the plugin protocol.
+func isJSONArray(r *bufio.Reader) bool {
+	for {
+		c, _, err := r.ReadRune()
+		if err != nil {
+			// No output at all is the same as an empty array.
+			return true
+		}
+		if !unicode.IsSpace(c) {
+			if err := r.UnreadRune(); err != nil {
+				return false
+			}
+			return c == '['
+		}
+	}
+}
+
+func (tp *targetPlugin) relayStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		tp.env().o.Out("%s\n", scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		tp.env().o.Debug("Reading target STDERR: %s\n", err)
+	}
+}
+
+// The targetExit function turns how the target command exited into an error,
+// if it didn't exit happily.
+func targetExit(err error, e Env) error {
+	if err == nil {
+		return nil
+	}
+	var exitCode int
+	if ee, ok := err.(*exec.ExitError); ok {
+		if status, ok := ee.Sys().(syscall.WaitStatus); ok {
+			exitCode = status.ExitStatus()
+		} else {
+			e.o.Debug("Unknown exit code, faking it.\n")
+			exitCode = 255
+		}
+	} else {
+		e.o.Debug("Unknown exit code, faking it.\n")
+		exitCode = 255
+	}
+	msg := fmt.Sprintf("Command returned non-zero (%d) exit.", exitCode)
+	return errors.New(msg)
+}
+
+// The start method reads the plugin's records until it says it's ready, or
+// exits.
+func (tp *targetPlugin) start(r *bufio.Reader, stderrDone *sync.WaitGroup) error {
+	if err := tp.env().s.SetTargetPlugin(tp); err != nil {
+		tp.kill()
+		return errors.New(err.Error() + " Stop it with target --stop.")
+	}
+	go tp.connector()
+	go func() {
+		err := tp.read(r)
+		if err != nil {
+			tp.kill()
+		}
+		stderrDone.Wait()
+		if wErr := targetExit(tp.cmd.Wait(), tp.env()); err == nil {
+			err = wErr
+		}
+		close(tp.kick)
+		tp.env().s.ClearTargetPlugin(tp)
+		tp.done <- err
+	}()
+	e := tp.env()
+	select {
+	case <-tp.ready:
+		if tp.report != nil {
+			outputSyncReport(e, *tp.report)
+			e.o.Out("The plugin keeps running.\n")
+		} else {
+			e.o.Out("Targeted %d hosts, the plugin keeps running.\n", tp.count())
+		}
+		// The session that started it can go away now, so from here on
+		// the plugin talks through our own output.
+		tp.detach()
+		go func() {
+			if err := <-tp.done; err != nil && !tp.wasStopped() {
+				tp.env().o.Err("Target plugin: %s\n", err)
+			}
+			tp.env().o.Debug("Target plugin is done.\n")
+		}()
+		return nil
+	case err := <-tp.done:
+		if err == errEmptySync {
+			return err
+		}
+		if tp.report != nil {
+			outputSyncReport(e, *tp.report)
+			return err
+		}
+		e.o.Out("Targeted %d hosts.\n", tp.count())
+		return err
+	}
+}
+
+func (tp *targetPlugin) env() Env {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.e
+}
+
+func (tp *targetPlugin) detach() {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if o := tp.e.s.GetMainOutput(); o != nil {
+		tp.e.o = o
+	}
+}
+
+func (tp *targetPlugin) wasStopped() bool {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.stopped
+}
+
+func (tp *targetPlugin) count() int {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.added - tp.removed
+}
+
+// The read method handles the plugin's records as they come in.
+func (tp *targetPlugin) read(r *bufio.Reader) error {
+	scanner := bufio.NewScanner(r)
+	// A host with a lot of meta can make for a long line.
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	hello := false
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var rec targetRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+		if !hello && rec.Op != targetOpHello {
+			return fmt.Errorf("line %d: expected a hello, got %q", n, rec.Op)
+		}
+		switch rec.Op {
+		case targetOpHello:
+			if rec.Version < 1 || rec.Version > TargetProtocolVersion {
+				return fmt.Errorf("plugin speaks version %d, we speak up to %d",
+					rec.Version, TargetProtocolVersion)
+			}
+			hello = true
+		case targetOpAdd:
+			if rec.Name == "" {
+				return fmt.Errorf("line %d: add without a name", n)
+			}
+			if tp.syncing {
+				tp.synced = append(tp.synced, rec.Server)
+				continue
+			}
+			added, err := NewJSON(tp.env()).LoadServers([]Server{rec.Server})
+			if err != nil {
+				return fmt.Errorf("line %d: %s", n, err)
+			}
+			if added > 0 {
+				tp.queue(rec.Name)
+			}
+		case targetOpRemove:
+			if tp.syncing {
+				tp.unsync(rec.Name)
+				continue
+			}
+			tp.dequeue(rec.Name)
+			if e := tp.env(); e.s.HostExists(rec.Name) {
+				removeTarget(e, rec.Name)
+				pruneProxies(e)
+				tp.mu.Lock()
+				tp.removed++
+				tp.mu.Unlock()
+			}
+		case targetOpReady:
+			if err := tp.reconcile(); err != nil {
+				return err
+			}
+			select {
+			case <-tp.ready:
+			default:
+				close(tp.ready)
+			}
+		default:
+			tp.env().o.Debug("Target plugin sent an unknown op: %s\n", rec.Op)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return tp.reconcile()
+}
+
+// The unsync method drops a host from the inventory we're collecting.
+func (tp *targetPlugin) unsync(name string) {
+	servers := tp.synced[:0]
+	for i := range tp.synced {
+		if tp.synced[i].Name != name {
+			servers = append(servers, tp.synced[i])
+		}
+	}
+	tp.synced = servers
+}
+
+// The reconcile method reconciles the targets with what we've collected for
+// target --sync, and puts the new hosts in line to be connected.
+func (tp *targetPlugin) reconcile() error {
+	if !tp.syncing {
+		return nil
+	}
+	tp.syncing = false
+	sr, err := reconcileTargets(tp.env(), tp.synced, tp.force)
+	if err != nil {
+		return err
+	}
+	tp.synced = nil
+	tp.report = &sr
+	fresh := sr.fresh()
+	for i := range fresh {
+		tp.queue(fresh[i])
+	}
+	return nil
+}
+
+// The queue method puts a new host in line to be connected.
+func (tp *targetPlugin) queue(host string) {
+	tp.mu.Lock()
+	tp.pending = append(tp.pending, host)
+	tp.added++
+	tp.mu.Unlock()
+	select {
+	case tp.kick <- struct{}{}:
+	default:
+	}
+}
+
+// The dequeue method takes a host that was removed out of line, if it's
+// still waiting to be connected.
+func (tp *targetPlugin) dequeue(host string) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	pending := tp.pending[:0]
+	for i := range tp.pending {
+		if tp.pending[i] != host {
+			pending = append(pending, tp.pending[i])
+		}
+	}
+	tp.pending = pending
+}
+
+// The connector method connects the hosts that come in, a batch at a time.
+// While one batch connects, the next one piles up.
+func (tp *targetPlugin) connector() {
+	for range tp.kick {
+		tp.mu.Lock()
+		batch := tp.pending
+		tp.pending = nil
+		tp.mu.Unlock()
+		if len(batch) > 0 {
+			e := tp.env()
+			connectEverywhere(e, batch, e.c.Timeout, noRetries)
+			sweepRemoved(e, batch)
+		}
+	}
+}
+
+// The sweepRemoved function disconnects the hosts out of hosts that were
+// removed from the targets while they were busy connecting, since removing
+// them couldn't disconnect what wasn't connected yet.
+func sweepRemoved(e Env, hosts []string) {
+	for _, host := range hosts {
+		if e.s.HostExists(host) {
+			continue
+		}
+		// Unless we need it to get to somebody else.
+		if ci, err := e.s.GetConnInfo(host); err != nil || ci.isProxy {
+			continue
+		}
+		if err := disconnectHost(e, host); err != nil {
+			e.o.Debug("disconnectHost(): %s\n", err)
+		}
+	}
+}
+
+func (tp *targetPlugin) kill() {
+	if err := syscall.Kill(-tp.cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		tp.env().o.Debug("Kill(): %s\n", err)
+	}
+}
+
+// The stopTarget function stops the target plugin running in the background.
+func stopTarget(e Env) error {
+	tp := e.s.GetTargetPlugin()
+	if tp == nil {
+		return errors.New("No target plugin is running.")
+	}
+	tp.mu.Lock()
+	tp.stopped = true
+	tp.mu.Unlock()
+	tp.kill()
+	e.o.Out("Stopped the target plugin.\n")
+	return nil
+}
+
+// The removeTarget function disconnects a host, if it's connected, and
+// drops it from the targets. It's up to the caller to prune the bastions it
+// leaves behind.
+func removeTarget(e Env, host string) {
+	if e.s.ConnExists(host) {
+		if err := disconnectHost(e, host); err != nil {
+			e.o.Debug("disconnectHost(): %s\n", err)
+		}
+	}
+	e.s.DeleteHostInfo(host)
+	e.s.ForgetHost(host)
+}
+
+// The pruneProxies function disconnects the bastions that none of the
+// targets go through anymore, and returns how many it disconnected. Like
+// disconnectEverywhere, the indirect ones go first, so nothing gets pulled
+// out from under a bastion we're about to get to anyway.
+func pruneProxies(e Env) int {
+	used := make(map[string]bool)
+	hk := e.s.GetHostKeys()
+	for i := range hk {
+		hi, err := e.s.GetHostInfo(hk[i])
+		if err != nil {
+			continue
+		}
+		for _, hop := range hi.chain[:len(hi.chain)-1] {
+			used[e.s.GetPTR(hop)] = true
+		}
+	}
+	count := 0
+	for _, direct := range []bool{false, true} {
+		ck := e.s.GetConnKeys()
+		for i := range ck {
+			if used[ck[i]] {
+				continue
+			}
+			ci, err := e.s.GetConnInfo(ck[i])
+			if err != nil || !ci.isProxy || ci.isDirect != direct {
+				continue
+			}
+			if err := disconnectHost(e, ck[i]); err != nil {
+				e.o.Debug("disconnectHost(): %s\n", err)
+				continue
+			}
+			e.s.ForgetHost(ck[i])
+			count++
+		}
+	}
+	// And the ones that were down when they stopped being needed.
+	flaps := e.s.GetFlapInfo()
+	for i := range flaps {
+		fi := flaps[i]
+		if fi.isProxy && !fi.reconnecting && !used[fi.hostName] {
+			e.s.ForgetHost(fi.hostName)
+		}
+	}
+	return count
+}